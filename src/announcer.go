@@ -0,0 +1,362 @@
+// Queues voice channel announcements per guild and coalesces bursts of events
+// into a single utterance.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/goproslowyo/discordgo"
+	"go.uber.org/zap"
+)
+
+// Used if announce_window_ms isn't set. It also gives a joining user's client a
+// moment to connect before the bot starts talking.
+const defaultAnnounceWindow = 1250 * time.Millisecond
+
+// How long synthesizing the clips of a window may take in total, including
+// retries. Announcements that come much later are pointless.
+const announceTimeout = 30 * time.Second
+
+// Spoken when an announcement can't be synthesized, e.g. during an outage of
+// the TTS provider. These clips are prepared at startup.
+var fallbackTexts = map[AnnounceEvent]string{
+	announceJoin:  "Someone joined.",
+	announceLeave: "Someone left.",
+	announceMove:  "Someone moved.",
+}
+
+// A voice channel event waiting to be announced.
+type Announcement struct {
+	Event     AnnounceEvent
+	ChannelID string // The channel to play the announcement in.
+	Arrival   bool   // Whether the user arrived in ChannelID.
+	UserID    string
+	Data      AnnounceData
+	Voice     VoiceProfile
+}
+
+// Events that are announced together have the same groupKey.
+type groupKey struct {
+	event     AnnounceEvent
+	channelID string
+	channel   string
+	from      string
+}
+
+func (a *Announcement) groupKey() groupKey {
+	return groupKey{
+		event:     a.Event,
+		channelID: a.ChannelID,
+		channel:   a.Data.Channel,
+		from:      a.Data.FromChannel,
+	}
+}
+
+// Announcer collects the announcements of one guild. All announcements arriving
+// within the window started by the first one are played as one, so five users
+// joining at once results in one herald and "A, B, C, D and E joined.".
+// Announcements pass through a Debouncer before entering the window.
+type Announcer struct {
+	sync.Mutex
+	s         *discordgo.Session
+	guildID   string
+	clock     Clock
+	debouncer *Debouncer
+	pending   []*Announcement
+	timer     Timer
+	// Held while flushing, so that a window is only played once the one
+	// before it was, even if rendering it takes longer than the window.
+	mFlush sync.Mutex
+}
+
+// Returns the announcer of the guild, creating it if it doesn't exist yet.
+func GetAnnouncer(s *discordgo.Session, guildID string) *Announcer {
+	mAnnouncers.Lock()
+	defer mAnnouncers.Unlock()
+	a, ok := announcers[guildID]
+	if !ok {
+		a = NewAnnouncer(s, guildID, realClock{})
+		announcers[guildID] = a
+	}
+	return a
+}
+
+func NewAnnouncer(s *discordgo.Session, guildID string, clock Clock) *Announcer {
+	a := &Announcer{
+		s:       s,
+		guildID: guildID,
+		clock:   clock,
+	}
+	a.debouncer = NewDebouncer(clock, a.enqueue)
+	return a
+}
+
+func announceWindow(gs *GuildSettings) time.Duration {
+	if gs.AnnounceWindowMs <= 0 {
+		return defaultAnnounceWindow
+	}
+	return time.Duration(gs.AnnounceWindowMs) * time.Millisecond
+}
+
+// Queues an announcement. Unless it is suppressed by the debouncer, it is
+// played once the current window closes.
+func (a *Announcer) Add(ann *Announcement) {
+	gs := GetGuildSettings(a.guildID)
+	flapWindow := time.Duration(gs.FlapWindowSecs) * time.Second
+	cooldown := time.Duration(gs.AnnounceCooldownSecs) * time.Second
+	a.debouncer.Offer(ann, flapWindow, cooldown)
+}
+
+func (a *Announcer) enqueue(ann *Announcement) {
+	a.Lock()
+	defer a.Unlock()
+	a.pending = append(a.pending, ann)
+	if a.timer == nil {
+		gs := GetGuildSettings(a.guildID)
+		a.timer = a.clock.AfterFunc(announceWindow(&gs), a.flush)
+	}
+}
+
+// Renders and plays everything that is pending.
+func (a *Announcer) flush() {
+	// The pending announcements are only taken once the previous flush is
+	// done. Until then, the timer stays set and new announcements join them.
+	a.mFlush.Lock()
+	defer a.mFlush.Unlock()
+	a.Lock()
+	pending := a.pending
+	a.pending = nil
+	a.timer = nil
+	a.Unlock()
+
+	keys, groups := groupAnnouncements(pending)
+	gs := GetGuildSettings(a.guildID)
+	ctx, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+
+	// All clips of a channel are played as one job, with at most one herald.
+	var channels []string
+	clips := make(map[string][]string)
+	// Channel ID to the users arriving there.
+	arrivals := make(map[string][]string)
+	for _, k := range keys {
+		group := groups[k]
+		groupClips := a.groupClips(ctx, &gs, k, group)
+		if len(groupClips) == 0 {
+			continue
+		}
+		if _, ok := clips[k.channelID]; !ok {
+			channels = append(channels, k.channelID)
+		}
+		clips[k.channelID] = append(clips[k.channelID], groupClips...)
+		for _, ann := range group {
+			if ann.Arrival {
+				arrivals[k.channelID] = append(arrivals[k.channelID], ann.UserID)
+			}
+		}
+	}
+
+	player := GetGuildPlayer(a.s, a.guildID)
+	for _, channelID := range channels {
+		files := clips[channelID]
+		if users := arrivals[channelID]; len(users) > 0 {
+			// A user arriving alone gets their own herald.
+			userID := ""
+			if len(users) == 1 {
+				userID = users[0]
+			}
+			if herald, ok := heralds.Pick(&gs, a.guildID, userID, time.Now()); ok {
+				files = append([]string{herald}, files...)
+			}
+		}
+		player.Play(channelID, files...)
+	}
+}
+
+// Groups the announcements that are announced together, returning the keys of
+// the groups in the order in which they first appeared.
+func groupAnnouncements(pending []*Announcement) ([]groupKey, map[groupKey][]*Announcement) {
+	var keys []groupKey
+	groups := make(map[groupKey][]*Announcement)
+	for _, ann := range pending {
+		k := ann.groupKey()
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], ann)
+	}
+	return keys, groups
+}
+
+// Returns the clips announcing a group of events: the spoken announcement, or
+// the fallback if it can't be synthesized, and the custom sound of a single
+// user.
+func (a *Announcer) groupClips(ctx context.Context, gs *GuildSettings, k groupKey, group []*Announcement) []string {
+	var sound *UserSound
+	var soundPath string
+	if len(group) == 1 {
+		if sound = gs.UserSound(group[0].UserID, k.event); sound != nil {
+			soundPath = userSoundPath(a.guildID, group[0].UserID, k.event)
+			if _, err := os.Stat(soundPath); err != nil {
+				logger.Warn("Custom sound is missing, using TTS", zap.String("path", soundPath), zap.Error(err))
+				sound = nil
+			}
+		}
+	}
+	if sound != nil && !sound.AfterTTS {
+		return []string{soundPath}
+	}
+
+	var clips []string
+	clip, err := getGroupClip(ctx, gs, group)
+	if err != nil {
+		logger.Error("Failed to get announcement clip, using the fallback",
+			zap.String("guild", a.guildID),
+			zap.String("event", k.event.String()),
+			zap.Error(err),
+		)
+		if fallback, ok := fallbackClip(k.event); ok {
+			clips = append(clips, fallback)
+		}
+	} else {
+		clips = append(clips, clip)
+	}
+	if sound != nil {
+		clips = append(clips, soundPath)
+	}
+	return clips
+}
+
+// Renders the announcement of a group of events of the same kind and returns
+// the path of its clip. A single announcement keeps the user's own voice,
+// groups are spoken with the default voice.
+func getGroupClip(ctx context.Context, gs *GuildSettings, group []*Announcement) (string, error) {
+	first := group[0]
+	if len(group) == 1 {
+		text, err := RenderAnnouncement(&gs.Templates, first.Event, first.Data)
+		if err != nil {
+			return "", err
+		}
+		return getSpeechClip(ctx, gs, text, first.Voice)
+	}
+
+	data := first.Data
+	data.Names = nil
+	var usernames, nicks, displayNames []string
+	for _, ann := range group {
+		data.Names = append(data.Names, ann.Data.Name)
+		usernames = append(usernames, ann.Data.Username)
+		nicks = append(nicks, orDefault(ann.Data.Nickname, ann.Data.Name))
+		displayNames = append(displayNames, orDefault(ann.Data.DisplayName, ann.Data.Name))
+	}
+	data.Name = joinNames(data.Names)
+	data.Username = joinNames(usernames)
+	data.Nickname = joinNames(nicks)
+	data.DisplayName = joinNames(displayNames)
+	data.Count = len(group)
+	// The last event has the most recent member count.
+	data.MemberCount = group[len(group)-1].Data.MemberCount
+
+	text, err := RenderAnnouncement(&gs.Templates, first.Event, data)
+	if err != nil {
+		return "", err
+	}
+	voice := gs.DefaultVoice.withDefaults(builtinVoice)
+	return getSpeechClip(ctx, gs, text, voice)
+}
+
+// Returns the clip speaking the speech markup, with the guild's pronunciations.
+func getSpeechClip(ctx context.Context, gs *GuildSettings, markup string, voice VoiceProfile) (string, error) {
+	speech, err := gs.Speech(markup)
+	if err != nil {
+		return "", fmt.Errorf("invalid SSML in '%s': %w", markup, err)
+	}
+	return GetAudioFile(ctx, speech, voice)
+}
+
+// Joins names the way they are spoken: "A", "A and B", "A, B and C".
+func joinNames(names []string) string {
+	switch len(names) {
+	case 0:
+		return ""
+	case 1:
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
+
+func orDefault(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+func fallbackClipPath(e AnnounceEvent) string {
+	// Not in the clip cache, so that they are never evicted.
+	return filepath.Join(cfg().UserAudioPath, "fallback", e.String()+".ogg")
+}
+
+// Returns the path of the generic clip for the event, if it exists.
+func fallbackClip(e AnnounceEvent) (string, bool) {
+	path := fallbackClipPath(e)
+	if _, err := os.Stat(path); err != nil {
+		logger.Warn("No fallback clip available", zap.String("event", e.String()), zap.Error(err))
+		return "", false
+	}
+	return path, true
+}
+
+// How long to wait before trying to synthesize missing fallback clips again,
+// doubling after every failure.
+const (
+	fallbackRetryMin = time.Minute
+	fallbackRetryMax = 30 * time.Minute
+)
+
+// Synthesizes the fallback clips that don't exist yet. The TTS provider may be
+// unavailable right when the bot starts, which is when the fallback is needed
+// most, so it keeps trying until all of them exist.
+func PrepareFallbackClips(ctx context.Context) {
+	retry := fallbackRetryMin
+	for !prepareFallbackClips(ctx) {
+		logger.Sugar().Warnf("Retrying to prepare the fallback clips in %s.", retry)
+		select {
+		case <-time.After(retry):
+		case <-ctx.Done():
+			return
+		}
+		retry = min(2*retry, fallbackRetryMax)
+	}
+}
+
+// Reports whether all fallback clips exist afterwards.
+func prepareFallbackClips(ctx context.Context) bool {
+	ok := true
+	for e, text := range fallbackTexts {
+		path := fallbackClipPath(e)
+		if _, err := os.Stat(path); err == nil || !errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			logger.Error("Failed to create the fallback clip directory", zap.Error(err))
+			return false
+		}
+		clip, err := ttsProvider.Synthesize(ctx, text, builtinVoice)
+		if err == nil {
+			err = os.WriteFile(path, clip, 0640)
+		}
+		if err != nil {
+			logger.Error("Failed to prepare fallback clip", zap.String("event", e.String()), zap.Error(err))
+			ok = false
+		}
+	}
+	return ok
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestJoinNames(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  string
+	}{
+		{nil, ""},
+		{[]string{"Alice"}, "Alice"},
+		{[]string{"Alice", "Bob"}, "Alice and Bob"},
+		{[]string{"Alice", "Bob", "Carol"}, "Alice, Bob and Carol"},
+		{[]string{"Alice", "Bob", "Carol", "Dave", "Eve"}, "Alice, Bob, Carol, Dave and Eve"},
+	}
+	for _, tt := range tests {
+		if got := joinNames(tt.names); got != tt.want {
+			t.Errorf("joinNames(%q) = %q, want %q", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestGroupAnnouncements(t *testing.T) {
+	ann := func(e AnnounceEvent, user, channelID, channel, from string) *Announcement {
+		return &Announcement{
+			Event:     e,
+			ChannelID: channelID,
+			UserID:    user,
+			Data:      AnnounceData{Name: user, Channel: channel, FromChannel: from},
+		}
+	}
+	pending := []*Announcement{
+		ann(announceJoin, "alice", "1", "General", ""),
+		ann(announceLeave, "bob", "1", "General", ""),
+		ann(announceJoin, "carol", "1", "General", ""),
+		// Moves are grouped by where they came from.
+		ann(announceMove, "dave", "1", "General", "Games"),
+		ann(announceMove, "eve", "1", "General", "Music"),
+		ann(announceMove, "frank", "1", "General", "Games"),
+		// Joins in another channel are announced there.
+		ann(announceJoin, "grace", "2", "Games", ""),
+		ann(announceLeave, "heidi", "1", "General", ""),
+	}
+	keys, groups := groupAnnouncements(pending)
+
+	want := []struct {
+		event     AnnounceEvent
+		channelID string
+		from      string
+		users     []string
+	}{
+		{announceJoin, "1", "", []string{"alice", "carol"}},
+		{announceLeave, "1", "", []string{"bob", "heidi"}},
+		{announceMove, "1", "Games", []string{"dave", "frank"}},
+		{announceMove, "1", "Music", []string{"eve"}},
+		{announceJoin, "2", "", []string{"grace"}},
+	}
+	if len(keys) != len(want) || len(groups) != len(want) {
+		t.Fatalf("got %d keys and %d groups, want %d", len(keys), len(groups), len(want))
+	}
+	for i, w := range want {
+		k := keys[i]
+		if k.event != w.event || k.channelID != w.channelID || k.from != w.from {
+			t.Errorf("group %d is %+v, want %v in %s from '%s'", i, k, w.event, w.channelID, w.from)
+			continue
+		}
+		var users []string
+		for _, a := range groups[k] {
+			users = append(users, a.UserID)
+		}
+		if joinNames(users) != joinNames(w.users) {
+			t.Errorf("group %d has %v, want %v", i, users, w.users)
+		}
+	}
+}
@@ -6,11 +6,12 @@ import (
 	"strings"
 )
 
-// CmdGetArgs returns a false and a nil slice if cmd was not intended for the bot.
-func CmdGetArgs(cmd string) (args []string, ok bool) {
-	if !strings.HasPrefix(cmd, cfg.Prefix) {
+// CmdGetArgs returns a false and a nil slice if cmd was not intended for the bot,
+// i.e. doesn't start with the guild's prefix.
+func CmdGetArgs(prefix, cmd string) (args []string, ok bool) {
+	if !strings.HasPrefix(cmd, prefix) {
 		return nil, false
 	}
-	cmd = strings.TrimPrefix(cmd, cfg.Prefix)
+	cmd = strings.TrimPrefix(cmd, prefix)
 	return strings.Fields(cmd), true
 }
@@ -7,8 +7,7 @@ import (
 	"os/exec"
 	"strconv"
 
-	"github.com/goproslowyo/discordgo"
-	"layeh.com/gopus"
+	"github.com/goproslowyo/trumpet/dca0"
 )
 
 // NOTE: This API is not final and these are likely to change.
@@ -17,61 +16,18 @@ import (
 // a lot of other problems that are not handled well at this time.
 // These below values seem to provide the best overall performance
 const (
-	channels  int = 2                   // 1 for mono, 2 for stereo
-	frameRate int = 48000               // audio sampling rate
-	frameSize int = 960                 // uint16 size of each audio frame
-	maxBytes  int = (frameSize * 2) * 2 // max size of opus data
+	channels  int = 2     // 1 for mono, 2 for stereo
+	frameRate int = 48000 // audio sampling rate
+	frameSize int = 960   // uint16 size of each audio frame
 )
 
-// SendPCM will receive on the provied channel encode
-// received PCM data into Opus then send that to Discordgo
-func SendPCM(v *discordgo.VoiceConnection, pcm <-chan []int16) {
-	if pcm == nil {
-		return
-	}
-
-	var err error
-
-	opusEncoder, err := gopus.NewEncoder(frameRate, channels, gopus.Audio)
-
-	if err != nil {
-		logger.Sugar().Errorf("NewEncoder Error: %s", err)
-		return
-	}
-
-	for {
-
-		// read pcm from chan, exit if channel is closed.
-		recv, ok := <-pcm
-		if !ok {
-			logger.Sugar().Warn("PCM Channel closed", nil)
-			return
-		}
-
-		// try encoding pcm frame with Opus
-		opus, err := opusEncoder.Encode(recv, frameSize, maxBytes)
-		if err != nil {
-			logger.Sugar().Errorf("Encoding Error: %s", err)
-			return
-		}
-
-		if !v.Ready || v.OpusSend == nil {
-			// OnError(fmt.Sprintf("Discordgo not ready for opus packets. %+v : %+v", v.Ready, v.OpusSend), nil)
-			// Sending errors here might not be suited
-			return
-		}
-		// send encoded opus data to the sendOpus channel
-		v.OpusSend <- opus
-	}
-}
-
-// PlayAudioFile will play the given filename to the already connected
-// Discord voice server/channel.  voice websocket and udp socket
-// must already be setup before this will work.
-func PlayAudioFile(v *discordgo.VoiceConnection, filename string, stop <-chan bool) {
+// PlayAudioFile will play the given filename through the guild's mixer, on
+// top of any music that is playing. It returns once the whole file has been
+// handed to the mixer.
+func PlayAudioFile(m *dca0.Mixer, filename string, stop <-chan bool) {
 
 	// Create a shell command "object" to run.
-	run := exec.Command("ffmpeg", "-i", filename, "-f", "s16le", "-ar", strconv.Itoa(frameRate), "-ac", strconv.Itoa(channels), "pipe:1")
+	run := exec.Command(cfg().FfmpegPath, "-i", filename, "-f", "s16le", "-ar", strconv.Itoa(frameRate), "-ac", strconv.Itoa(channels), "pipe:1")
 	ffmpegout, err := run.StdoutPipe()
 	if err != nil {
 		logger.Sugar().Errorf("StdoutPipe Error", err)
@@ -103,29 +59,6 @@ func PlayAudioFile(v *discordgo.VoiceConnection, filename string, stop <-chan bo
 		}
 	}()
 
-	// Send "speaking" packet over the voice websocket
-	err = v.Speaking(true)
-	if err != nil {
-		logger.Sugar().Errorf("Couldn't set speaking", err)
-	}
-
-	// Send not "speaking" packet over the websocket when we finish
-	defer func() {
-		err := v.Speaking(false)
-		if err != nil {
-			logger.Sugar().Errorf("Couldn't stop speaking", err)
-		}
-	}()
-
-	send := make(chan []int16, 2)
-	defer close(send)
-
-	close := make(chan bool)
-	go func() {
-		SendPCM(v, send)
-		close <- true
-	}()
-
 	for {
 		// read data from ffmpeg stdout
 		audiobuf := make([]int16, frameSize*channels)
@@ -138,11 +71,7 @@ func PlayAudioFile(v *discordgo.VoiceConnection, filename string, stop <-chan bo
 			return
 		}
 
-		// Send received PCM to the sendPCM channel
-		select {
-		case send <- audiobuf:
-		case <-close:
-			return
-		}
+		// Send received PCM to the mixer, which takes one frame per 20ms.
+		m.Overlay() <- audiobuf
 	}
 }
@@ -0,0 +1,323 @@
+// A content addressed cache of synthesized announcement clips. Clips are named
+// after a hash of everything that affects how they sound, so changing a
+// template, name or voice simply results in a new clip, and clips that are no
+// longer used are evicted by age and size.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const cacheIndexFile = "index.json"
+
+// How often the index is written if only the last use of clips changed. Cache
+// hits are frequent, and losing some of them on a crash doesn't matter much.
+const cacheIndexFlushInterval = time.Minute
+
+type cacheEntry struct {
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+	// Zero for clips that were pre-generated and never played.
+	LastUsed time.Time `json:"last_used"`
+}
+
+// Clips that were never played count as used when they were created.
+func (e *cacheEntry) lastUse() time.Time {
+	if e.LastUsed.IsZero() {
+		return e.Created
+	}
+	return e.LastUsed
+}
+
+// Reports whether e is evicted before o: clips that were never played come
+// first, so that pre-generating clips doesn't push out the ones in use.
+func (e *cacheEntry) evictsBefore(o *cacheEntry) bool {
+	if e.LastUsed.IsZero() != o.LastUsed.IsZero() {
+		return e.LastUsed.IsZero()
+	}
+	return e.lastUse().Before(o.lastUse())
+}
+
+type ClipCache struct {
+	sync.Mutex
+	dir      string
+	maxBytes int64         // 0 means no limit.
+	maxAge   time.Duration // Since last use; 0 means no limit.
+	entries  map[string]*cacheEntry
+	size     int64
+	// Whether the index has changes that weren't written yet.
+	dirty bool
+	// Since the start of the bot.
+	hits, misses int
+}
+
+type CacheStats struct {
+	Entries      int
+	Size         int64
+	MaxBytes     int64
+	MaxAge       time.Duration
+	Hits, Misses int
+	Oldest       time.Time // Least recently used.
+}
+
+// Opens the cache in dir, reading its index. Clips that aren't in the index,
+// like the per-user files of older versions, are deleted.
+func OpenClipCache(dir string, maxBytes int64, maxAge time.Duration) (*ClipCache, error) {
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, err
+	}
+	cc := &ClipCache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		maxAge:   maxAge,
+		entries:  make(map[string]*cacheEntry),
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cacheIndexFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &cc.entries); err != nil {
+			logger.Sugar().Warnf("Clip cache index is corrupted, starting over: %s", err)
+			cc.entries = make(map[string]*cacheEntry)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.ogg"))
+	if err != nil {
+		return nil, err
+	}
+	onDisk := make(map[string]bool)
+	for _, f := range files {
+		key := strings.TrimSuffix(filepath.Base(f), ".ogg")
+		if _, ok := cc.entries[key]; !ok {
+			logger.Debug("Removing unindexed clip", zap.String("file", f))
+			os.Remove(f)
+			continue
+		}
+		onDisk[key] = true
+	}
+	for key, e := range cc.entries {
+		if !onDisk[key] {
+			delete(cc.entries, key)
+			continue
+		}
+		cc.size += e.Size
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+	cc.evict()
+	cc.save()
+	go cc.flushPeriodically()
+	return cc, nil
+}
+
+// Returns a hash of everything that determines what a clip sounds like.
+func clipKey(provider string, voice VoiceProfile, text string) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%g|%g|%s",
+		provider, voice.LanguageCode, voice.Name, voice.SpeakingRate, voice.Pitch, text)))
+	return fmt.Sprintf("%x", sum[:16])
+}
+
+// Reports whether the clip is cached, without counting it as a use.
+func (cc *ClipCache) Has(providerName string, text string, voice VoiceProfile) bool {
+	cc.Lock()
+	defer cc.Unlock()
+	_, ok := cc.entries[clipKey(providerName, voice, text)]
+	return ok
+}
+
+func (cc *ClipCache) path(key string) string {
+	return filepath.Join(cc.dir, key+".ogg")
+}
+
+// Returns the path of the clip speaking text in the given voice, synthesizing
+// it if it isn't cached.
+func (cc *ClipCache) Get(ctx context.Context, provider TTSProvider, providerName string, text string, voice VoiceProfile) (string, error) {
+	return cc.get(ctx, provider, providerName, text, voice, true)
+}
+
+// Synthesizes the clip if it isn't cached, without counting it as a use.
+func (cc *ClipCache) Warm(ctx context.Context, provider TTSProvider, providerName string, text string, voice VoiceProfile) error {
+	_, err := cc.get(ctx, provider, providerName, text, voice, false)
+	return err
+}
+
+func (cc *ClipCache) get(ctx context.Context, provider TTSProvider, providerName string, text string, voice VoiceProfile, use bool) (string, error) {
+	key := clipKey(providerName, voice, text)
+	path := cc.path(key)
+
+	cc.Lock()
+	if e, ok := cc.entries[key]; ok {
+		if use {
+			e.LastUsed = time.Now()
+			cc.hits++
+			cc.dirty = true
+		}
+		cc.Unlock()
+		return path, nil
+	}
+	if use {
+		cc.misses++
+	}
+	cc.Unlock()
+
+	logger.Info("Clip isn't cached, synthesizing...", zap.String("text", text))
+	clip, err := provider.Synthesize(ctx, text, voice)
+	if err != nil {
+		return "", fmt.Errorf("failed to synthesize '%s': %w", text, err)
+	}
+	// Write atomically, another announcement may be playing the same clip.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, clip, 0640); err != nil {
+		return "", fmt.Errorf("failed to write audio file: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", fmt.Errorf("failed to write audio file: %w", err)
+	}
+
+	cc.Lock()
+	defer cc.Unlock()
+	now := time.Now()
+	e := &cacheEntry{Size: int64(len(clip)), Created: now}
+	if old, ok := cc.entries[key]; ok {
+		// Synthesized concurrently.
+		cc.size -= old.Size
+		e.LastUsed = old.LastUsed
+	}
+	if use {
+		e.LastUsed = now
+	}
+	cc.entries[key] = e
+	cc.size += int64(len(clip))
+	cc.evict()
+	cc.save()
+	return path, nil
+}
+
+// Removes clips that haven't been used for maxAge, then the ones that were
+// never played and then the least recently used ones until the cache fits into
+// maxBytes. The lock must be held.
+func (cc *ClipCache) evict() {
+	keys := make([]string, 0, len(cc.entries))
+	for key := range cc.entries {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return cc.entries[keys[i]].evictsBefore(cc.entries[keys[j]])
+	})
+	// Never evict the clip that was just used; it is about to be played.
+	if len(keys) > 0 && !cc.entries[keys[len(keys)-1]].LastUsed.IsZero() {
+		keys = keys[:len(keys)-1]
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		e := cc.entries[key]
+		expired := cc.maxAge > 0 && now.Sub(e.lastUse()) > cc.maxAge
+		tooBig := cc.maxBytes > 0 && cc.size > cc.maxBytes
+		if expired || tooBig {
+			cc.remove(key)
+		}
+	}
+}
+
+// The lock must be held.
+func (cc *ClipCache) remove(key string) {
+	if err := os.Remove(cc.path(key)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Failed to remove clip", zap.String("key", key), zap.Error(err))
+	}
+	cc.size -= cc.entries[key].Size
+	delete(cc.entries, key)
+}
+
+// Writes the index. The lock must be held.
+func (cc *ClipCache) save() {
+	data, err := json.Marshal(cc.entries)
+	if err != nil {
+		logger.Error("Failed to encode clip cache index", zap.Error(err))
+		return
+	}
+	index := filepath.Join(cc.dir, cacheIndexFile)
+	tmp := index + ".tmp"
+	err = os.WriteFile(tmp, data, 0640)
+	if err == nil {
+		err = os.Rename(tmp, index)
+	}
+	if err != nil {
+		logger.Error("Failed to write clip cache index", zap.Error(err))
+		return
+	}
+	cc.dirty = false
+}
+
+// Writes the index if it has unwritten changes.
+func (cc *ClipCache) Flush() {
+	cc.Lock()
+	defer cc.Unlock()
+	if cc.dirty {
+		cc.save()
+	}
+}
+
+func (cc *ClipCache) flushPeriodically() {
+	for range time.Tick(cacheIndexFlushInterval) {
+		cc.Flush()
+	}
+}
+
+// Clips are only generated ahead of time while the cache is less full than
+// this, so that they don't push out each other or the clips that are played.
+const warmCacheShare = 0.9
+
+// Reports whether there is room for clips generated ahead of time.
+func (cc *ClipCache) HasRoomToWarm() bool {
+	cc.Lock()
+	defer cc.Unlock()
+	return cc.maxBytes <= 0 || float64(cc.size) < warmCacheShare*float64(cc.maxBytes)
+}
+
+func (cc *ClipCache) Stats() CacheStats {
+	cc.Lock()
+	defer cc.Unlock()
+	st := CacheStats{
+		Entries:  len(cc.entries),
+		Size:     cc.size,
+		MaxBytes: cc.maxBytes,
+		MaxAge:   cc.maxAge,
+		Hits:     cc.hits,
+		Misses:   cc.misses,
+	}
+	for _, e := range cc.entries {
+		if st.Oldest.IsZero() || e.lastUse().Before(st.Oldest) {
+			st.Oldest = e.lastUse()
+		}
+	}
+	return st
+}
+
+// Deletes all clips and returns how many there were.
+func (cc *ClipCache) Purge() int {
+	cc.Lock()
+	defer cc.Unlock()
+	n := len(cc.entries)
+	for key := range cc.entries {
+		cc.remove(key)
+	}
+	cc.save()
+	return n
+}
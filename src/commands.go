@@ -17,37 +17,31 @@ import (
 // //////////////////////////////
 // Helper functions.
 // //////////////////////////////
-func generateHelpMsg() string {
+func generateHelpMsg(prefix string) string {
 	// Align all commands nicely so that the descriptions are in the same
 	// column.
 	longestCmd := 0
 	var cmds, descs []string
-	addCmd := func(cmd, desc string) {
-		if len(cmd) > longestCmd {
-			longestCmd = len(cmd)
+	for _, cmd := range commands {
+		line := cmd.Name
+		if cmd.Usage != "" {
+			line += " " + cmd.Usage
 		}
-		cmds = append(cmds, cmd)
+		desc := cmd.Description
+		if len(cmd.Aliases) > 0 {
+			desc += " (alias: " + strings.Join(cmd.Aliases, ", ") + ")"
+		}
+		if len(line) > longestCmd {
+			longestCmd = len(line)
+		}
+		cmds = append(cmds, line)
 		descs = append(descs, desc)
 	}
-	addCmd("help", "show this page")
-	addCmd("play <URL|query>", "play audio from a URL or a youtube search query")
-	addCmd("play", "start playing queue/resume playback")
-	addCmd("seek <time>", "seek to the specified time (format: mm:ss or seconds)")
-	addCmd("pos", "get the current playback time")
-	addCmd("loop", "start/stop looping the current track")
-	addCmd("add <URL|query>", "add a URL or a youtube search query to the queue; note: be patient when adding large playlists")
-	addCmd("queue", "print the current queue; used to obtain track IDs for some other commands")
-	addCmd("pause", "pause playback")
-	addCmd("stop", "clear playlist and stop playback")
-	addCmd("skip", "skip the current track")
-	addCmd("delete <ID|ID-ID>...", "delete one or multiple tracks from the queue")
-	addCmd("swap <ID> <ID>", "swap the position of two tracks in the queue")
-	addCmd("shuffle", "shuffle all items in the current queue")
 
 	var msg strings.Builder
 	msg.WriteString("Commands:\n")
 	for i := range cmds {
-		msg.WriteString("\u2022 `" + cfg.Prefix + cmds[i])
+		msg.WriteString("\u2022 `" + prefix + cmds[i])
 		msg.WriteString(strings.Repeat(" ", longestCmd-len(cmds[i])))
 		msg.WriteString(" - " + descs[i] + "`\n")
 	}
@@ -68,32 +62,23 @@ func dcSanitize(in string) string {
 	return strings.ReplaceAll(in, "||", "\\|\\|")
 }
 
-// //////////////////////////////
-// Global variables.
-// //////////////////////////////
-var helpMsg string
-
 // //////////////////////////////
 // The actual commands.
 // //////////////////////////////
-func commandHelp(c *Client) {
-	// We're not generating the help message in the var declaration because
-	// generateHelpMsg() relies on the config which hasn't been read at that
-	// point.
-	if helpMsg == "" {
-		helpMsg = generateHelpMsg()
-	}
-	c.Messagef("%s", helpMsg)
+func commandHelp(ctx *CommandContext) {
+	// The prefix differs between guilds, so the message isn't cached.
+	ctx.Messagef("%s", generateHelpMsg(ctx.c.Prefix()))
 }
 
-func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []string) {
+func commandPlay(ctx *CommandContext) {
+	s, g, c, args := ctx.s, ctx.g, ctx.c, ctx.Args
 	c.DebugLog("Play command called with args: %+s\n", args)
 	var playbackActive bool
 	{
 		var playback Playback
 		if playback, playbackActive = c.GetPlaybackInfo(); playbackActive {
 			if playback.Paused {
-				c.Messagef("Resuming playback.")
+				ctx.Messagef("Resuming playback.")
 				c.DebugLog("Resuming playback for: %s\n", playback.Title)
 				playback.CmdCh <- dca0.CommandResume{}
 				c.Lock()
@@ -105,14 +90,14 @@ func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []str
 	}
 
 	if c.QueueLen() == 0 && len(args) == 0 {
-		c.Messagef("Nothing in queue. Please add an item to the queue or specify a URL or a youtube search query.")
+		ctx.Messagef("Nothing in queue. Please add an item to the queue or specify a URL or a youtube search query.")
 		return
 	}
 
 	if len(args) > 0 {
 		// Add the current track/playlist in place.
 		c.DebugLog("Adding to queue: %s\n", args)
-		commandAdd(c, args, false)
+		commandAdd(ctx, args, false)
 		// We only want one player active at once.
 		if playbackActive {
 			return
@@ -120,16 +105,17 @@ func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []str
 	}
 
 	if c.VoiceChannelID == "" {
-		c.Messagef("I don't know which voice channel to join.")
+		ctx.Messagef("I don't know which voice channel to join.")
 		return
 	}
 
-	vc, err := s.ChannelVoiceJoin(g.ID, c.VoiceChannelID, false, true)
-	if err != nil {
-		c.Messagef("Error joining voice channel: %s.", err)
+	// The player keeps the bot in this channel until the queue is done.
+	player := GetGuildPlayer(s, g.ID)
+	if err := player.StartMusic(c.VoiceChannelID); err != nil {
+		ctx.Messagef("Error joining voice channel: %s.", err)
 		return
 	}
-	defer vc.Disconnect()
+	defer player.StopMusic()
 
 	// Set playback to nothing once we're done or if an error occurs.
 	defer func() {
@@ -142,13 +128,16 @@ func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []str
 	for c.QueueLen() > 0 {
 		track, _ := c.QueuePopFront()
 		mediaUrl := track.MediaUrl
-		c.Messagef("Playing: %s.\n", dcSanitize(track.Title))
+		ctx.Messagef("Playing: %s.\n", dcSanitize(track.Title))
 
 		// Set up dca0 encoder.
-		dcaOpts := dca0.GetDefaultOptions(cfg.FfmpegPath)
+		dcaOpts := dca0.GetDefaultOptions(cfg().FfmpegPath)
+		dcaOpts.Loudnorm = musicLoudnorm(track)
+		dcaOpts.OnLoudness = saveMusicLoudness(track, dcaOpts.Loudnorm)
+		dcaOpts.Live = track.Live
 		enc, err := dca0.NewEncoder(dcaOpts)
 		if err != nil {
-			c.Messagef("Error: %s.", err)
+			ctx.Messagef("Error: %s.", err)
 			return
 		}
 
@@ -168,10 +157,13 @@ func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []str
 		// We just set the playback info so we don't have to check if it's there.
 		playback, _ := c.GetPlaybackInfo()
 		errCh := make(chan error)
-		// Start downloading and sending audio data.
-		vc.Speaking(true)
+		// Start downloading and sending audio data. It goes through the
+		// mixer, so that announcements can be played on top of it.
+		mixer := player.mixer
+		mixer.SetMusicVolume(float64(GetGuildSettings(g.ID).MusicVolume) / 100)
 		go func() {
-			enc.GetOpusFrames(mediaUrl, dcaOpts, vc.OpusSend, errCh, playback.CmdCh, playback.RespCh)
+			enc.GetOpusFrames(mediaUrl, dcaOpts, mixer.Music(), errCh, playback.CmdCh, playback.RespCh)
+			mixer.FlushMusic()
 			close(errCh)
 		}()
 		// Process errors: Get and print the first error put out by the extractor.
@@ -182,23 +174,23 @@ func commandPlay(s *discordgo.Session, g *discordgo.Guild, c *Client, args []str
 			}
 		}
 		if err != nil {
-			c.Messagef("Playback error: %s.", err)
+			ctx.Messagef("Playback error: %s.", err)
 			return
 		}
 		// Done with this song.
 		playback, _ = c.GetPlaybackInfo()
 
 	}
-	c.Messagef("Done playing queue.")
-	vc.Speaking(false)
+	ctx.Messagef("Done playing queue.")
 }
 
 // If inPlace is set to true, the track will be added to the front and replace
 // the currently playing one. If inPlace is set to true when dealing with a
 // playlist, the entire queue is replaced with that playlist.
-func commandAdd(c *Client, args []string, inPlace bool) {
+func commandAdd(ctx *CommandContext, args []string, inPlace bool) {
+	c := ctx.c
 	if len(args) < 1 {
-		c.Messagef("Please specify a URL or a youtube search query.")
+		ctx.Messagef("Please specify a URL or a youtube search query.")
 		return
 	}
 
@@ -211,15 +203,15 @@ func commandAdd(c *Client, args []string, inPlace bool) {
 	// TODO: This is some very shitty detection for if we're dealing with a
 	// playlist.
 	if strings.HasPrefix(path.Base(input), "list") {
-		c.Messagef("Long playlists may take a while to add, please be patient.")
+		ctx.Messagef("Long playlists may take a while to add, please be patient.")
 	}
 
 	logger.Debug("Creating new metadata extractor")
-	ytdlEx := ytdl.NewExtractor(cfg.YtdlPath)
+	ytdlEx := ytdl.NewExtractor(cfg().YtdlPath)
 
 	meta, err := ytdlEx.GetMetadata(input)
 	if err != nil {
-		c.Messagef("Error getting audio metadata: %s.", err)
+		ctx.Messagef("Error getting audio metadata: %s.", err)
 		return
 	}
 
@@ -227,7 +219,7 @@ func commandAdd(c *Client, args []string, inPlace bool) {
 	if len(meta) != 1 {
 		plural = "s"
 	}
-	c.Messagef("Adding %d track%s to queue.", len(meta), plural)
+	ctx.Messagef("Adding %d track%s to queue.", len(meta), plural)
 
 	isPlaylist := len(meta) > 1
 	if inPlace && isPlaylist {
@@ -238,13 +230,13 @@ func commandAdd(c *Client, args []string, inPlace bool) {
 		title, titleOk := m["title"]
 		webpageUrl, webpageUrlOk := m["webpage_url"]
 		if !(titleOk && webpageUrlOk) {
-			c.Messagef("Error getting video metadata: title=%t, url=%t.", titleOk, webpageUrlOk)
+			ctx.Messagef("Error getting video metadata: title=%t, url=%t.", titleOk, webpageUrlOk)
 			return
 		}
 
 		mediaUrl, err := ytdl.GetAudioURL(m)
 		if err != nil {
-			c.Messagef("Error getting URL: %s.", err)
+			ctx.Messagef("Error getting URL: %s.", err)
 			return
 		}
 
@@ -252,6 +244,7 @@ func commandAdd(c *Client, args []string, inPlace bool) {
 			Title:    title.(string),
 			Url:      webpageUrl.(string),
 			MediaUrl: mediaUrl,
+			Live:     ytdl.IsLive(m),
 		}
 		if inPlace && !isPlaylist {
 			// To replace the currently playing track (if one is currently
@@ -267,11 +260,12 @@ func commandAdd(c *Client, args []string, inPlace bool) {
 	}
 }
 
-func commandQueue(c *Client) {
+func commandQueue(ctx *CommandContext) {
+	c := ctx.c
 	playback, playbackOk := c.GetPlaybackInfo()
 	ql := c.QueueLen()
 	if ql == 0 && !playbackOk {
-		c.Messagef("Queue is empty.")
+		ctx.Messagef("Queue is empty.")
 		return
 	}
 
@@ -280,7 +274,7 @@ func commandQueue(c *Client) {
 	// flush() writes the string buffer into a new Discord message, then clears
 	// the buffer.
 	flush := func() {
-		c.Messagef("%s", msg.String())
+		ctx.Messagef("%s", msg.String())
 		msg.Reset()
 		msg.WriteString("\u2800\n")
 	}
@@ -303,50 +297,91 @@ func commandQueue(c *Client) {
 	flush()
 }
 
-func commandSeek(c *Client, args []string) {
+func commandSeek(ctx *CommandContext) {
+	c, args := ctx.c, ctx.Args
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
-	const invalidFormat = "Please specify where to seek, either in seconds or in the format of mm:ss."
+	const invalidFormat = "Please specify where to seek, either in seconds or in the format of mm:ss, optionally prefixed with + or - to seek relative to the current position."
 	if len(args) == 0 {
-		c.Messagef(invalidFormat)
+		ctx.Messagef(invalidFormat)
+		return
+	}
+	seek, ok := parseSeekArg(args[0])
+	if !ok {
+		ctx.Messagef(invalidFormat)
 		return
 	}
-	splits := strings.Split(args[0], ":")
+	var pos int64
+	if seek.relative {
+		playback.CmdCh <- dca0.CommandGetPlaybackTime{}
+		t, ok := (<-playback.RespCh).(dca0.ResponsePlaybackTime)
+		if !ok {
+			ctx.Messagef("Error receiving response: invalid type.")
+			return
+		}
+		pos = int64(t)
+	}
+	secs := seek.target(pos)
+	ctx.Messagef("Seeking to %s.", secsToMinsSecs(int(secs)))
+	playback.CmdCh <- dca0.CommandSeek(secs)
+}
+
+// Where to seek to: seconds or mm:ss, or with +30 and -1:00 relative to the
+// current position.
+type seekArg struct {
+	secs     int64 // Negative when seeking back.
+	relative bool
+}
+
+func parseSeekArg(arg string) (seekArg, bool) {
+	var sign int64 = 1
+	relative := false
+	if strings.HasPrefix(arg, "+") {
+		relative, arg = true, arg[1:]
+	} else if strings.HasPrefix(arg, "-") {
+		sign, relative, arg = -1, true, arg[1:]
+	}
+	splits := strings.Split(arg, ":")
 	var sMins, sSecs string
 	if len(splits) == 2 {
 		sMins, sSecs = splits[0], splits[1]
 	} else if len(splits) == 1 {
 		sMins, sSecs = "", splits[0]
 	} else {
-		c.Messagef(invalidFormat)
-		return
+		return seekArg{}, false
 	}
 	var mins, secs int64
 	var err error
 	if sMins != "" {
 		mins, err = strconv.ParseInt(sMins, 10, 32)
 		if err != nil {
-			c.Messagef(invalidFormat)
-			return
+			return seekArg{}, false
 		}
 	}
 	secs, err = strconv.ParseInt(sSecs, 10, 32)
-	if err != nil {
-		c.Messagef(invalidFormat)
-		return
+	if err != nil || mins < 0 || secs < 0 {
+		return seekArg{}, false
 	}
-	secs = 60*mins + secs
-	c.Messagef("Seeking to %s.", secsToMinsSecs(int(secs)))
-	playback.CmdCh <- dca0.CommandSeek(secs)
+	return seekArg{secs: sign * (60*mins + secs), relative: relative}, true
 }
 
-func commandPos(c *Client) {
+// Returns the position to seek to in seconds, given the current one. Seeking
+// back never goes before the start.
+func (a seekArg) target(pos int64) int64 {
+	if !a.relative {
+		return a.secs
+	}
+	return max(pos+a.secs, 0)
+}
+
+func commandPos(ctx *CommandContext) {
+	c := ctx.c
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
 	var sTime, sDur string
@@ -356,7 +391,7 @@ func commandPos(c *Client) {
 	if t, ok := respTime.(dca0.ResponsePlaybackTime); ok {
 		sTime = secsToMinsSecs(int(t))
 	} else {
-		c.Messagef("Error receiving response: invalid type.")
+		ctx.Messagef("Error receiving response: invalid type.")
 		return
 	}
 	// Attempt to get duration.
@@ -368,63 +403,111 @@ func commandPos(c *Client) {
 	case dca0.ResponseDuration:
 		sDur = secsToMinsSecs(int(d))
 	default:
-		c.Messagef("Error receiving response: invalid type.")
+		ctx.Messagef("Error receiving response: invalid type.")
 		return
 	}
 
-	c.Messagef("Current playback position: %s / %s.", sTime, sDur)
+	ctx.Messagef("Current playback position: %s / %s.", sTime, sDur)
 }
 
-func commandLoop(c *Client) {
+func commandLoop(ctx *CommandContext) {
+	c := ctx.c
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
 
 	if playback.Loop {
 		playback.CmdCh <- dca0.CommandStopLooping{}
-		c.Messagef("Looping disabled.")
+		ctx.Messagef("Looping disabled.")
 	} else {
 		playback.CmdCh <- dca0.CommandStartLooping{}
-		c.Messagef("Looping enabled.")
+		ctx.Messagef("Looping enabled.")
 	}
 	c.Lock()
 	c.Playback.Loop = !playback.Loop
 	c.Unlock()
 }
 
-func commandStop(c *Client) {
+// The maximum volume in percent. Anything louder is mostly distortion.
+const maxVolume = 200
+
+func commandVolume(ctx *CommandContext) {
+	const usage = "Usage: `volume [music|announce] [0-200]`."
+	gs := GetGuildSettings(ctx.g.ID)
+	args := ctx.Args
+	target := "music"
+	if len(args) > 0 && (args[0] == "music" || args[0] == "announce") {
+		target = args[0]
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		ctx.Messagef("Music volume: %d%%, announcement volume: %d%%.", gs.MusicVolume, gs.AnnounceVolume)
+		return
+	}
+	if len(args) > 1 {
+		ctx.Messagef(usage)
+		return
+	}
+	volume, err := strconv.Atoi(strings.TrimSuffix(args[0], "%"))
+	if err != nil || volume < 0 || volume > maxVolume {
+		ctx.Messagef("The volume must be between 0 and %d%%. %s", maxVolume, usage)
+		return
+	}
+
+	if target == "announce" {
+		if !requireAdmin(ctx, "Sorry, only admins can change the announcement volume.") {
+			return
+		}
+		if saveSettings(ctx, func(gs *GuildSettings) { gs.AnnounceVolume = volume }) {
+			ctx.Messagef("Announcement volume set to %d%%.", volume)
+		}
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) { gs.MusicVolume = volume }) {
+		return
+	}
+	if _, ok := ctx.c.GetPlaybackInfo(); ok {
+		GetGuildPlayer(ctx.s, ctx.g.ID).mixer.SetMusicVolume(float64(volume) / 100)
+	}
+	ctx.Messagef("Music volume set to %d%%.", volume)
+}
+
+func commandStop(ctx *CommandContext) {
+	c := ctx.c
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
-	c.Messagef("Stopping playback.")
+	ctx.Messagef("Stopping playback.")
 	c.QueueClear()
 	playback.CmdCh <- dca0.CommandStop{}
 }
 
-func commandSkip(c *Client) {
+func commandSkip(ctx *CommandContext) {
+	c := ctx.c
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
-	c.Messagef("Skipping current track.")
+	ctx.Messagef("Skipping current track.")
 	playback.CmdCh <- dca0.CommandStop{}
 }
 
-func commandPause(c *Client) {
+func commandPause(ctx *CommandContext) {
+	c := ctx.c
 	playback, ok := c.GetPlaybackInfo()
 	if !ok {
-		c.Messagef("Not playing anything.")
+		ctx.Messagef("Not playing anything.")
 		return
 	}
 	if playback.Paused {
-		c.Messagef("Already paused.")
+		ctx.Messagef("Already paused.")
 	} else {
-		c.Messagef("Pausing playback.")
+		ctx.Messagef("Pausing playback.")
 		playback.CmdCh <- dca0.CommandPause{}
 		c.Lock()
 		c.Playback.Paused = true
@@ -432,9 +515,10 @@ func commandPause(c *Client) {
 	}
 }
 
-func commandDelete(c *Client, args []string) {
+func commandDelete(ctx *CommandContext) {
+	c, args := ctx.c, ctx.Args
 	if len(args) < 1 {
-		c.Messagef("Please specify which item(s) to delete from the queue. IDs can be obtained with %squeue.", cfg.Prefix)
+		ctx.Messagef("Please specify which item(s) to delete from the queue. IDs can be obtained with %squeue.", c.Prefix())
 		return
 	}
 
@@ -447,12 +531,12 @@ func commandDelete(c *Client, args []string) {
 			for i, s := range splits {
 				id, err := strconv.ParseInt(s, 10, 32)
 				if err != nil {
-					c.Messagef("Invalid format: %s.", arg)
+					ctx.Messagef("Invalid format: %s.", arg)
 					return
 				}
 				id--
 				if id < 0 || int(id) >= c.QueueLen() {
-					c.Messagef("Index out of bounds: %s.", arg)
+					ctx.Messagef("Index out of bounds: %s.", arg)
 					return
 				}
 				ids[i] = int(id)
@@ -461,7 +545,7 @@ func commandDelete(c *Client, args []string) {
 				toDel[ids[0]] = struct{}{}
 			} else {
 				if ids[0] > ids[1] {
-					c.Messagef("The first id of the range must be not be larger: %s.", arg)
+					ctx.Messagef("The first id of the range must be not be larger: %s.", arg)
 					return
 				}
 				for i := ids[0]; i <= ids[1]; i++ {
@@ -469,7 +553,7 @@ func commandDelete(c *Client, args []string) {
 				}
 			}
 		default:
-			c.Messagef("Invalid format: %s.", arg)
+			ctx.Messagef("Invalid format: %s.", arg)
 			return
 		}
 	}
@@ -486,10 +570,33 @@ func commandDelete(c *Client, args []string) {
 	c.Lock()
 	c.Queue = newQueue
 	c.Unlock()
-	c.Messagef("Successfully deleted %d items.", len(toDel))
+	ctx.Messagef("Successfully deleted %d items.", len(toDel))
+}
+
+func commandSwap(ctx *CommandContext) {
+	c, args := ctx.c, ctx.Args
+	if len(args) != 2 {
+		ctx.Messagef("Please specify the IDs of the two tracks to swap. IDs can be obtained with %squeue.", c.Prefix())
+		return
+	}
+	var ids [2]int
+	for i, arg := range args {
+		id, err := strconv.ParseInt(arg, 10, 32)
+		if err != nil {
+			ctx.Messagef("Invalid format: %s.", arg)
+			return
+		}
+		ids[i] = int(id) - 1
+	}
+	if !c.QueueSwap(ids[0], ids[1]) {
+		ctx.Messagef("Index out of bounds.")
+		return
+	}
+	ctx.Messagef("Successfully swapped tracks %d and %d.", ids[0]+1, ids[1]+1)
 }
 
-func commandShuffle(c *Client) {
+func commandShuffle(ctx *CommandContext) {
+	c := ctx.c
 	seed := rand.Int63()
 	rand.New(rand.NewSource(seed))
 	queueLen := c.QueueLen()
@@ -498,10 +605,10 @@ func commandShuffle(c *Client) {
 		c.Queue[a], c.Queue[b] = c.Queue[b], c.Queue[a]
 	})
 	c.Unlock()
-	c.Messagef("Successfully shuffled %d items.", queueLen)
+	ctx.Messagef("Successfully shuffled %d items.", queueLen)
 }
 
-func commandJoin(s *discordgo.Session, g *discordgo.Guild, c *Client, m *discordgo.MessageCreate) {
+func commandJoin(s *discordgo.Session, g *discordgo.Guild, c *Client) {
 	// Get the voice channel the user is in (if any), otherwise let's bail
 	if c.VoiceChannelID == "" {
 		logger.Info("No VoiceChannelID associated with message")
@@ -515,14 +622,14 @@ func commandJoin(s *discordgo.Session, g *discordgo.Guild, c *Client, m *discord
 	guildId := g.ID
 	logger.Sugar().Infof("Attempting to join voice channel %s", channelId)
 
-	_, err := s.ChannelVoiceJoin(guildId, channelId, false, true)
+	_, err := JoinVoiceChannel(s, guildId, channelId)
 	if err != nil {
 		logger.Sugar().Infof("Error joining voice channel: %s.", err)
 		return
 	}
 }
 
-func commandPart(s *discordgo.Session, g *discordgo.Guild, c *Client, m *discordgo.MessageCreate) {
+func commandPart(s *discordgo.Session, g *discordgo.Guild, c *Client) {
 	logger.Info(fmt.Sprintf("Disconnecting from voice channel %s", c.VoiceChannelID))
 	c.RLock()
 	s.VoiceConnections[g.ID].Disconnect()
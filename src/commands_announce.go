@@ -0,0 +1,395 @@
+// Commands for managing how users are announced.
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goproslowyo/discordgo"
+	"go.uber.org/zap"
+)
+
+// //////////////////////////////
+// Helper functions.
+// //////////////////////////////
+// Returns the user ID if s is a user mention like <@123> or <@!123>.
+func parseMention(s string) (string, bool) {
+	if !strings.HasPrefix(s, "<@") || !strings.HasSuffix(s, ">") {
+		return "", false
+	}
+	id := strings.TrimPrefix(strings.TrimSuffix(s[2:], ">"), "!")
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// Returns the role ID if s is a role mention like <@&123>.
+func parseRoleMention(s string) (string, bool) {
+	if !strings.HasPrefix(s, "<@&") || !strings.HasSuffix(s, ">") {
+		return "", false
+	}
+	id := s[3 : len(s)-1]
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return "", false
+	}
+	return id, true
+}
+
+// Reports whether the author is an admin, sending a message if not.
+func requireAdmin(ctx *CommandContext, msg string) bool {
+	gp := GetGuildSettings(ctx.g.ID).Permissions
+	if memberPermission(ctx.g, &gp, ctx.Author.ID, ctx.Member) < PermAdmin {
+		ctx.Messagef("%s", msg)
+		return false
+	}
+	return true
+}
+
+// Returns the user an announcement settings command applies to, which is the
+// first mentioned user or the author if nobody was mentioned, and the
+// remaining arguments. Only admins may change the settings of other users; if
+// the author isn't allowed to, a message is sent and ok is false.
+func settingsTarget(ctx *CommandContext) (user *discordgo.User, args []string, ok bool) {
+	var targetID string
+	for _, arg := range ctx.Args {
+		if id, isMention := parseMention(arg); isMention && targetID == "" {
+			targetID = id
+			continue
+		}
+		args = append(args, arg)
+	}
+	if targetID == "" || targetID == ctx.Author.ID {
+		return ctx.Author, args, true
+	}
+
+	if !requireAdmin(ctx, "Sorry, only admins can change the announcement settings of other users.") {
+		return nil, nil, false
+	}
+	member, err := ctx.s.GuildMember(ctx.g.ID, targetID)
+	if err != nil {
+		ctx.Messagef("Couldn't find that user.")
+		return nil, nil, false
+	}
+	return member.User, args, true
+}
+
+// Removes the entry of the user, including deprecated ones keyed by username.
+func deleteUserKeys[V any](m map[string]V, user *discordgo.User) {
+	for k := range m {
+		if k == user.ID || (!isSnowflake(k) && strings.EqualFold(k, user.Username)) {
+			delete(m, k)
+		}
+	}
+}
+
+// Returns the ID of the user or role to (un)ignore, the username (empty for
+// roles) and how to call it in messages. Only admins may ignore roles.
+func ignoreTarget(ctx *CommandContext) (id, username, name string, ok bool) {
+	for _, arg := range ctx.Args {
+		if roleID, isRole := parseRoleMention(arg); isRole {
+			if !requireAdmin(ctx, "Sorry, only admins can ignore roles.") {
+				return "", "", "", false
+			}
+			name = "Members of " + arg
+			if role, err := ctx.s.State.Role(ctx.g.ID, roleID); err == nil {
+				name = "Members of " + dcSanitize(role.Name)
+			}
+			return roleID, "", name, true
+		}
+	}
+	user, _, ok := settingsTarget(ctx)
+	if !ok {
+		return "", "", "", false
+	}
+	return user.ID, user.Username, dcSanitize(user.Username), true
+}
+
+// Saves a settings change of the guild made by a command and reports errors to
+// the user.
+func saveSettings(ctx *CommandContext, update func(gs *GuildSettings)) bool {
+	err := store.UpdateGuild(ctx.g.ID, func(gs *GuildSettings) error {
+		update(gs)
+		return nil
+	})
+	if err != nil {
+		logger.Error("Failed to save guild settings", zap.String("guild", ctx.g.ID), zap.Error(err))
+		ctx.Messagef("Error saving settings: %s.", err)
+		return false
+	}
+	return true
+}
+
+// //////////////////////////////
+// The actual commands.
+// //////////////////////////////
+func commandSetName(ctx *CommandContext) {
+	user, args, ok := settingsTarget(ctx)
+	if !ok {
+		return
+	}
+	name := strings.Join(args, " ")
+	if name == "" {
+		ctx.Messagef("Please specify the name to announce.")
+		return
+	}
+	if _, err := checkName(name); err != nil {
+		ctx.Messagef("That name isn't valid: %s.", dcSanitize(err.Error()))
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		if gs.CustomNames == nil {
+			gs.CustomNames = make(map[string]string)
+		}
+		deleteUserKeys(gs.CustomNames, user)
+		gs.CustomNames[user.ID] = name
+	}) {
+		return
+	}
+	ctx.Messagef("%s will now be announced as \"%s\".", dcSanitize(user.Username), dcSanitize(name))
+}
+
+func commandClearName(ctx *CommandContext) {
+	user, _, ok := settingsTarget(ctx)
+	if !ok {
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		deleteUserKeys(gs.CustomNames, user)
+	}) {
+		return
+	}
+	ctx.Messagef("%s will now be announced by their username.", dcSanitize(user.Username))
+}
+
+func commandIgnore(ctx *CommandContext) {
+	id, _, name, ok := ignoreTarget(ctx)
+	if !ok {
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		if !slices.Contains(gs.IgnoreList, id) {
+			gs.IgnoreList = append(gs.IgnoreList, id)
+		}
+	}) {
+		return
+	}
+	ctx.Messagef("%s will no longer be announced.", name)
+}
+
+func commandUnignore(ctx *CommandContext) {
+	id, username, name, ok := ignoreTarget(ctx)
+	if !ok {
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		var list []string
+		for _, ignored := range gs.IgnoreList {
+			// Also drop deprecated username entries.
+			if ignored != id && (isSnowflake(ignored) || username == "" || ignored != username) {
+				list = append(list, ignored)
+			}
+		}
+		gs.IgnoreList = list
+	}) {
+		return
+	}
+	ctx.Messagef("%s will be announced again.", name)
+}
+
+// Shows or changes the voice profile of a user. Options are given as
+// key=value pairs, "reset" goes back to the default voice.
+func commandAnnounceOpts(ctx *CommandContext) {
+	user, args, ok := settingsTarget(ctx)
+	if !ok {
+		return
+	}
+	if len(args) == 0 {
+		gs := GetGuildSettings(ctx.g.ID)
+		v := gs.VoiceFor(user)
+		ctx.Messagef("Voice of %s: lang=%s voice=%s rate=%g pitch=%g.",
+			dcSanitize(user.Username), v.LanguageCode, v.Name, v.SpeakingRate, v.Pitch)
+		return
+	}
+
+	const usage = "Usage: `announceopts [@user] [lang=<code>] [voice=<name>] [rate=<0.25-4>] [pitch=<-20-20>]` or `announceopts [@user] reset`."
+	reset := len(args) == 1 && args[0] == "reset"
+	gs := GetGuildSettings(ctx.g.ID)
+	v, _ := lookupUser(gs.Voices, "voices", user)
+	for _, arg := range args {
+		if reset {
+			break
+		}
+		key, value, found := strings.Cut(arg, "=")
+		if !found {
+			ctx.Messagef(usage)
+			return
+		}
+		var err error
+		switch key {
+		case "lang":
+			v.LanguageCode = value
+		case "voice":
+			v.Name = value
+		case "rate":
+			v.SpeakingRate, err = strconv.ParseFloat(value, 64)
+			if err == nil && (v.SpeakingRate < 0.25 || v.SpeakingRate > 4) {
+				err = errors.New("out of range")
+			}
+		case "pitch":
+			v.Pitch, err = strconv.ParseFloat(value, 64)
+			if err == nil && (v.Pitch < -20 || v.Pitch > 20) {
+				err = errors.New("out of range")
+			}
+		default:
+			ctx.Messagef(usage)
+			return
+		}
+		if err != nil {
+			ctx.Messagef("Invalid value for %s: %s. %s", key, dcSanitize(value), usage)
+			return
+		}
+	}
+
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		if gs.Voices == nil {
+			gs.Voices = make(map[string]VoiceProfile)
+		}
+		deleteUserKeys(gs.Voices, user)
+		if !reset {
+			gs.Voices[user.ID] = v
+		}
+	}) {
+		return
+	}
+	gs = GetGuildSettings(ctx.g.ID)
+	v = gs.VoiceFor(user)
+	ctx.Messagef("Voice of %s is now: lang=%s voice=%s rate=%g pitch=%g.",
+		dcSanitize(user.Username), v.LanguageCode, v.Name, v.SpeakingRate, v.Pitch)
+}
+
+// The maximum length of the text spoken by a preview, in characters.
+const maxPreviewLength = 200
+
+// Reports whether the text is one of the member's names, as opposed to
+// arbitrary text.
+func isOwnName(gs *GuildSettings, member *discordgo.Member, text string) bool {
+	custom, _ := gs.CustomName(member.User)
+	if _, err := checkName(custom); err != nil {
+		// Set before names were checked.
+		custom = ""
+	}
+	for _, name := range []string{custom, member.Nick, member.User.GlobalName, member.User.Username} {
+		if name != "" && strings.EqualFold(strings.TrimSpace(name), text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Speaks the author's join announcement, or the given text (which may be
+// SSML), in their voice channel, so that names and pronunciations can be tried
+// out. Only DJs may make the bot speak anything but their own name.
+func commandPreview(ctx *CommandContext) {
+	channelID, ok := GetUserVoiceChannel(ctx.g, ctx.Author.ID)
+	if !ok || channelID == "" {
+		ctx.Messagef("Please join a voice channel first.")
+		return
+	}
+	player := GetGuildPlayer(ctx.s, ctx.g.ID)
+	if musicChannelID, ok := player.MusicChannel(); ok && musicChannelID != channelID {
+		ctx.Messagef("Music is playing in another channel, I can't preview in yours right now.")
+		return
+	}
+	gs := GetGuildSettings(ctx.g.ID)
+	member := ctx.Member
+	if member == nil {
+		var err error
+		if member, err = ctx.s.GuildMember(ctx.g.ID, ctx.Author.ID); err != nil {
+			ctx.Messagef("Couldn't find you in this server.")
+			return
+		}
+	}
+
+	markup := strings.Join(ctx.Args, " ")
+	if len([]rune(markup)) > maxPreviewLength {
+		ctx.Messagef("The text may be at most %d characters long.", maxPreviewLength)
+		return
+	}
+	if markup != "" && !isOwnName(&gs, member, markup) &&
+		memberPermission(ctx.g, &gs.Permissions, ctx.Author.ID, member) < PermDJ {
+		ctx.Messagef("Sorry, you need a DJ role to preview anything but your own name.")
+		return
+	}
+	if markup == "" {
+		data := memberAnnounceData(&gs, member)
+		data.setTime(time.Now())
+		if ch, err := ctx.s.State.Channel(channelID); err == nil {
+			data.Channel = escapeSpeech(sanitizePronunciation(ch.Name))
+		}
+		var err error
+		if markup, err = RenderAnnouncement(&gs.Templates, announceJoin, data); err != nil {
+			ctx.Messagef("Error rendering the join template: %s.", dcSanitize(err.Error()))
+			return
+		}
+	}
+
+	speech, err := gs.Speech(markup)
+	if err != nil {
+		ctx.Messagef("That isn't valid SSML: %s.", dcSanitize(err.Error()))
+		return
+	}
+	c, cancel := context.WithTimeout(context.Background(), announceTimeout)
+	defer cancel()
+	clip, err := GetAudioFile(c, speech, gs.VoiceFor(ctx.Author))
+	if err != nil {
+		logger.Error("Failed to synthesize preview", zap.Error(err))
+		ctx.Messagef("Error synthesizing the preview: %s.", dcSanitize(err.Error()))
+		return
+	}
+	player.Play(channelID, clip)
+	ctx.Messagef("Speaking: %s", dcSanitize(speech))
+}
+
+// Shows statistics of the clip cache or empties it. The cache is shared by
+// all guilds.
+func commandCache(ctx *CommandContext) {
+	if len(ctx.Args) != 1 {
+		ctx.Messagef("Usage: `cache stats` or `cache purge`.")
+		return
+	}
+	switch ctx.Args[0] {
+	case "stats":
+		st := clipCache.Stats()
+		limit := "no size limit"
+		if st.MaxBytes > 0 {
+			limit = fmt.Sprintf("limit %.1f MB", float64(st.MaxBytes)/(1<<20))
+		}
+		age := "kept until evicted by size"
+		if st.MaxAge > 0 {
+			age = fmt.Sprintf("evicted after %d days unused", int(st.MaxAge.Hours()/24))
+		}
+		msg := fmt.Sprintf("%d clips, %.1f MB (%s), %s. Since start: %d hits, %d misses.",
+			st.Entries, float64(st.Size)/(1<<20), limit, age, st.Hits, st.Misses)
+		if !st.Oldest.IsZero() {
+			msg += fmt.Sprintf(" Least recently used clip: %s.", st.Oldest.Format("2006-01-02 15:04"))
+		}
+		ctx.Messagef("%s", msg)
+	case "purge":
+		// Admins of one guild mustn't throw away the clips of all others.
+		if !cfg().isOwner(ctx.Author.ID) {
+			ctx.Messagef("Sorry, only the owners of the bot can purge the cache.")
+			return
+		}
+		n := clipCache.Purge()
+		logger.Sugar().Infof("Clip cache purged by %s on server %s.", ctx.Author.Username, ctx.g.ID)
+		ctx.Messagef("Deleted %d clips. They will be synthesized again when needed.", n)
+	default:
+		ctx.Messagef("Usage: `cache stats` or `cache purge`.")
+	}
+}
@@ -0,0 +1,136 @@
+// The settings command, giving admins access to all settings of their guild.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// //////////////////////////////
+// Helper functions.
+// //////////////////////////////
+// Converts the settings to a map of their JSON keys to JSON values, so that
+// single settings can be read and written by name.
+func settingsFields(gs *GuildSettings) (map[string]json.RawMessage, error) {
+	data, err := json.Marshal(gs)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(data, &fields)
+	return fields, err
+}
+
+// Replaces the setting key with the JSON value.
+func setSetting(gs *GuildSettings, key string, value json.RawMessage) error {
+	fields, err := settingsFields(gs)
+	if err != nil {
+		return err
+	}
+	if _, ok := fields[key]; !ok || key == "version" {
+		return fmt.Errorf("unknown setting '%s'", key)
+	}
+	fields[key] = value
+	data, err := json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+	var updated GuildSettings
+	if err := json.Unmarshal(data, &updated); err != nil {
+		return fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+	if updated.Prefix == "" || strings.ContainsAny(updated.Prefix, " \t\n") {
+		return errors.New("the prefix must not be empty or contain spaces")
+	}
+	for _, v := range []int{updated.MusicVolume, updated.AnnounceVolume} {
+		if v < 0 || v > maxVolume {
+			return fmt.Errorf("volumes must be between 0 and %d", maxVolume)
+		}
+	}
+	for id, name := range updated.CustomNames {
+		if old, ok := gs.CustomNames[id]; ok && old == name {
+			continue
+		}
+		if _, err := checkName(name); err != nil {
+			return fmt.Errorf("invalid custom name for %s: %w", id, err)
+		}
+	}
+	*gs = updated
+	return nil
+}
+
+// //////////////////////////////
+// The actual commands.
+// //////////////////////////////
+func commandSettings(ctx *CommandContext) {
+	const usage = "Usage: `settings`, `settings get <key>`, `settings set <key> <JSON value>` or `settings reset <key>`."
+	gs := GetGuildSettings(ctx.g.ID)
+	fields, err := settingsFields(&gs)
+	if err != nil {
+		ctx.Messagef("Error reading settings: %s.", err)
+		return
+	}
+
+	if len(ctx.Args) == 0 {
+		var keys []string
+		for k := range fields {
+			if k != "version" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		ctx.Messagef("Settings: `%s`. %s", strings.Join(keys, "`, `"), usage)
+		return
+	}
+	if len(ctx.Args) < 2 {
+		ctx.Messagef(usage)
+		return
+	}
+
+	key := ctx.Args[1]
+	switch ctx.Args[0] {
+	case "get":
+		value, ok := fields[key]
+		if !ok {
+			ctx.Messagef("Unknown setting '%s'.", dcSanitize(key))
+			return
+		}
+		msg := string(value)
+		// Stay below Discord's message length limit.
+		if len(msg) > 1800 {
+			msg = msg[:1800] + "..."
+		}
+		ctx.Messagef("`%s`: ```json\n%s\n```", key, msg)
+		return
+	case "set":
+		if len(ctx.Args) < 3 {
+			ctx.Messagef(usage)
+			return
+		}
+		value := json.RawMessage(strings.Join(ctx.Args[2:], " "))
+		err = store.UpdateGuild(ctx.g.ID, func(gs *GuildSettings) error {
+			return setSetting(gs, key, value)
+		})
+	case "reset":
+		def := defaultGuildSettings()
+		var defFields map[string]json.RawMessage
+		if defFields, err = settingsFields(&def); err != nil {
+			ctx.Messagef("Error reading settings: %s.", err)
+			return
+		}
+		err = store.UpdateGuild(ctx.g.ID, func(gs *GuildSettings) error {
+			return setSetting(gs, key, defFields[key])
+		})
+	default:
+		ctx.Messagef(usage)
+		return
+	}
+	if err != nil {
+		ctx.Messagef("Error changing %s: %s.", dcSanitize(key), dcSanitize(err.Error()))
+		return
+	}
+	ctx.Messagef("Changed %s.", dcSanitize(key))
+}
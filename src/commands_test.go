@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSeekArg(t *testing.T) {
+	tests := []struct {
+		arg    string
+		pos    int64
+		want   int64
+		wantOK bool
+	}{
+		{"90", 300, 90, true},
+		{"0", 300, 0, true},
+		{"1:30", 300, 90, true},
+		{"0:05", 300, 5, true},
+		{"10:", 300, 0, false},
+		{":30", 300, 30, true},
+		{"+30", 300, 330, true},
+		{"+1:00", 300, 360, true},
+		{"-10", 300, 290, true},
+		{"-1:00", 30, 0, true},
+		{"-400", 300, 0, true},
+		{"-0", 300, 300, true},
+		{"+", 300, 0, false},
+		{"--10", 300, 0, false},
+		{"+-10", 300, 0, false},
+		{"1:-5", 300, 0, false},
+		{"1:2:3", 300, 0, false},
+		{"1.5", 300, 0, false},
+		{"abc", 300, 0, false},
+		{"", 300, 0, false},
+	}
+	for _, tt := range tests {
+		seek, ok := parseSeekArg(tt.arg)
+		if ok != tt.wantOK {
+			t.Errorf("parseSeekArg(%q) = %+v, %t; want ok %t", tt.arg, seek, ok, tt.wantOK)
+			continue
+		}
+		if ok && seek.target(tt.pos) != tt.want {
+			t.Errorf("seeking to %q at %d goes to %d, want %d", tt.arg, tt.pos, seek.target(tt.pos), tt.want)
+		}
+	}
+}
@@ -6,19 +6,152 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/goproslowyo/trumpet/dca0"
 )
 
 type Config struct {
-	CustomNames                     map[string]string `json:"custom_names"`
-	FfmpegPath                      string            `json:"ffmpeg_path"`
-	AnnouncementPath                string            `json:"announcement_path"`
-	GoogleServiceAccountCredentials string            `json:"google_service_account_credentials"`
-	IgnoreList                      []string          `json:"ignore_list"`
-	Prefix                          string            `json:"prefix"`
-	Token                           string            `json:"token"`
-	UserAudioPath                   string            `json:"user_audio_path"`
-	YtdlPath                        string            `json:"youtube-dl_path"`
-	ConfigHash                      string
+	ClipCacheMaxMB                  int      `json:"clip_cache_max_mb"`
+	ClipCacheMaxAgeDays             int      `json:"clip_cache_max_age_days"`
+	DatabasePath                    string   `json:"database_path"`
+	FfmpegPath                      string   `json:"ffmpeg_path"`
+	AnnouncementPath                string   `json:"announcement_path"`
+	GoogleServiceAccountCredentials string   `json:"google_service_account_credentials"`
+	LocalTTSPath                    string   `json:"local_tts_path"`
+	LoudnessTargetLUFS              float64  `json:"loudness_target_lufs"`
+	NormalizeLoudness               bool     `json:"normalize_loudness"`
+	OwnerIDs                        []string `json:"owner_ids"`
+	PiperModel                      string   `json:"piper_model"`
+	PrewarmPerMinute                int      `json:"prewarm_per_minute"`
+	PrewarmWorkers                  int      `json:"prewarm_workers"`
+	SoundsPath                      string   `json:"sounds_path"`
+	Token                           string   `json:"token"`
+	TTSProvider                     string   `json:"tts_provider"`
+	UserAudioPath                   string   `json:"user_audio_path"`
+	YtdlPath                        string   `json:"youtube-dl_path"`
+	ConfigHash                      string   `json:"-"`
+}
+
+const (
+	defaultClipCacheMaxMB      = 256
+	defaultClipCacheMaxAgeDays = 30
+)
+
+// Reports whether the user operates the bot and may therefore run commands
+// that affect all guilds.
+func (c *Config) isOwner(userID string) bool {
+	for _, id := range c.OwnerIDs {
+		if id == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Size limit of the clip cache. clip_cache_max_mb = 0 uses the default, a
+// negative value disables the limit.
+func (c *Config) clipCacheMaxBytes() int64 {
+	switch {
+	case c.ClipCacheMaxMB == 0:
+		return defaultClipCacheMaxMB << 20
+	case c.ClipCacheMaxMB < 0:
+		return 0
+	}
+	return int64(c.ClipCacheMaxMB) << 20
+}
+
+// Clips unused for longer are evicted. clip_cache_max_age_days = 0 uses the
+// default, a negative value keeps them forever.
+func (c *Config) clipCacheMaxAge() time.Duration {
+	switch {
+	case c.ClipCacheMaxAgeDays == 0:
+		return defaultClipCacheMaxAgeDays * 24 * time.Hour
+	case c.ClipCacheMaxAgeDays < 0:
+		return 0
+	}
+	return time.Duration(c.ClipCacheMaxAgeDays) * 24 * time.Hour
+}
+
+const (
+	defaultPrewarmWorkers   = 2
+	defaultPrewarmPerMinute = 30
+)
+
+// Number of workers pre-generating clips. prewarm_workers = 0 uses the
+// default, a negative value disables pre-generating.
+func (c *Config) prewarmWorkers() int {
+	if c.PrewarmWorkers <= 0 {
+		return defaultPrewarmWorkers
+	}
+	return c.PrewarmWorkers
+}
+
+// TTS requests per minute made for pre-generating clips.
+func (c *Config) prewarmPerMinute() int {
+	if c.PrewarmPerMinute <= 0 {
+		return defaultPrewarmPerMinute
+	}
+	return c.PrewarmPerMinute
+}
+
+// EBU R128 recommends -23 LUFS for broadcasting, but that is too quiet next to
+// other voice chat participants; -16 is common for streaming.
+const defaultLoudnessTarget = -16
+
+// The loudness normalization options, and whether normalization is enabled.
+// loudness_target_lufs = 0 uses the default.
+func (c *Config) loudnorm() (dca0.LoudnormOptions, bool) {
+	target := c.LoudnessTargetLUFS
+	if target == 0 {
+		target = defaultLoudnessTarget
+	}
+	return dca0.GetDefaultLoudnormOptions(target), c.NormalizeLoudness
+}
+
+const defaultSoundsPath = "sounds"
+
+// Directory of the sounds uploaded with setsound.
+func (c *Config) soundsPath() string {
+	if c.SoundsPath == "" {
+		return defaultSoundsPath
+	}
+	return c.SoundsPath
+}
+
+// VoiceProfile describes how a user's announcements are spoken. Zero fields
+// fall back to the guild's default_voice, and then to builtinVoice.
+type VoiceProfile struct {
+	LanguageCode string  `json:"language_code"` // BCP-47, for example "de-DE".
+	Name         string  `json:"name"`          // Provider specific voice name.
+	SpeakingRate float64 `json:"speaking_rate"` // 1.0 is normal speed.
+	Pitch        float64 `json:"pitch"`         // In semitones, -20 to 20.
+}
+
+// The voice used before voice profiles were configurable.
+var builtinVoice = VoiceProfile{
+	LanguageCode: "en-US",
+	Name:         "en-US-Wavenet-F",
+	SpeakingRate: 1.5,
+}
+
+// Fills in the zero fields of v with the ones from def.
+func (v VoiceProfile) withDefaults(def VoiceProfile) VoiceProfile {
+	if v.LanguageCode == "" {
+		v.LanguageCode = def.LanguageCode
+		// A voice name only makes sense together with its language.
+		if v.Name == "" {
+			v.Name = def.Name
+		}
+	}
+	if v.SpeakingRate == 0 {
+		v.SpeakingRate = def.SpeakingRate
+	}
+	if v.Pitch == 0 {
+		v.Pitch = def.Pitch
+	}
+	return v
 }
 
 const configFile = "/trumpet/config.json"
@@ -29,33 +162,69 @@ func (c *Config) hashConfig(config []byte) string {
 	return fmt.Sprintf("%x", sha256.Sum256(config))
 }
 
-func ReadConfig(cfg *Config) error {
+// The current configuration. It is shared by all goroutines, so a Config is
+// never modified once it is current; a changed config.json replaces it.
+var currentConfig atomic.Pointer[Config]
+
+// Returns the current configuration.
+func cfg() *Config {
+	return currentConfig.Load()
+}
+
+// How often config.json is checked for changes.
+const configCheckInterval = 10 * time.Second
+
+func ReadConfig() (*Config, error) {
 	configData, err := os.ReadFile(configFile)
 	if err != nil {
-		return errors.New("unable to read config file: " + err.Error())
+		return nil, errors.New("unable to read config file: " + err.Error())
+	}
+	c := &Config{}
+	if err := json.Unmarshal(configData, c); err != nil {
+		return nil, errors.New("unable to decode config file: " + err.Error())
 	}
-	newHash := cfg.hashConfig(configData)
+	c.ConfigHash = c.hashConfig(configData)
+	return c, nil
+}
 
-	if cfg.ConfigHash != newHash || cfg.ConfigHash == "" {
-		json.Unmarshal(configData, cfg)
-		if err != nil {
-			return errors.New("unable to decode config file: " + err.Error())
-		}
-		cfg.ConfigHash = newHash
-		logger.Sugar().Infof("Config file (re)loaded, hash: %s\n", cfg.ConfigHash)
+// Makes config.json the current configuration if it changed.
+func reloadConfig() error {
+	c, err := ReadConfig()
+	if err != nil {
+		return err
+	}
+	if old := cfg(); old == nil || old.ConfigHash != c.ConfigHash {
+		currentConfig.Store(c)
+		logger.Sugar().Infof("Config file (re)loaded, hash: %s\n", c.ConfigHash)
 	}
 	return nil
 }
 
+// Reloads config.json whenever it changes.
+func watchConfig() {
+	for range time.Tick(configCheckInterval) {
+		if err := reloadConfig(); err != nil {
+			logger.Sugar().Errorf("Error: Failed to re-read config file: %s", err)
+		}
+	}
+}
+
 func WriteDefaultConfig() error {
 	data, err := json.MarshalIndent(Config{
-		CustomNames:                     map[string]string{},
+		ClipCacheMaxMB:                  defaultClipCacheMaxMB,
+		ClipCacheMaxAgeDays:             defaultClipCacheMaxAgeDays,
+		DatabasePath:                    "trumpet.db",
 		FfmpegPath:                      "ffmpeg",
 		AnnouncementPath:                "announcements",
 		GoogleServiceAccountCredentials: "google-translate-api-credentials.json",
-		IgnoreList:                      []string{},
-		Prefix:                          "!",
+		LoudnessTargetLUFS:              defaultLoudnessTarget,
+		NormalizeLoudness:               true,
+		OwnerIDs:                        []string{},
 		Token:                           tokenDefaultString,
+		PrewarmPerMinute:                defaultPrewarmPerMinute,
+		PrewarmWorkers:                  defaultPrewarmWorkers,
+		SoundsPath:                      defaultSoundsPath,
+		TTSProvider:                     ttsProviderGoogle,
 		UserAudioPath:                   "audio/",
 		YtdlPath:                        "/home/nonroot/.local/bin/yt-dlp",
 	}, "", "\t")
@@ -6,20 +6,11 @@ import (
 	"io"
 	"os"
 	"os/exec"
-	"strconv"
 	"time"
 
 	"layeh.com/gopus"
 )
 
-type CacheOverflowError struct {
-	MaxCacheBytes int
-}
-
-func (e *CacheOverflowError) Error() string {
-	return "audio too large: the maximum cache limit of " + strconv.Itoa(e.MaxCacheBytes) + " bytes has been exceeded"
-}
-
 type Command interface{}
 
 type CommandStop struct{}
@@ -44,10 +35,23 @@ type Dca0Options struct {
 	// changing the pitch because of how discord and opus work).
 	FrameSize int
 	Bitrate   int
-	// Maximum number of bytes that may be cached. A 3-minute song usually uses
-	// about 2.7MB. If the capacity is full, an error will be sent and the
-	// function will exit.
+	// Maximum number of bytes of opus frames kept in memory. A 3-minute song
+	// usually uses about 2.7MB. Beyond that, the frames of a live stream are
+	// dropped, oldest first, and those of other inputs are moved to a
+	// temporary file in SpillDir ("" for the default temporary directory).
 	MaxCacheBytes int
+	SpillDir      string
+	// Maximum size of the temporary file, 0 for no limit. Beyond that, the
+	// frames are dropped like those of live streams once they were played,
+	// and the encoder waits while MaxCacheBytes haven't been played yet.
+	MaxSpillBytes int64
+	// Whether the input is a live stream, which never ends.
+	Live bool
+	// If the input is normalized dynamically (Loudnorm without Measured),
+	// this is called with its loudness once it was encoded completely, so
+	// that it can be normalized linearly the next time. It isn't called if
+	// the input was stopped or seeked before that.
+	OnLoudness func(m *LoudnessMeasurement)
 }
 
 func GetDefaultOptions(ffmpegPath string) Dca0Options {
@@ -58,6 +62,8 @@ func GetDefaultOptions(ffmpegPath string) Dca0Options {
 		Bitrate: 64000,
 		// Max cache size of 100MB.
 		MaxCacheBytes: 100000000,
+		// Max temporary file size of 1GB, about 18 hours.
+		MaxSpillBytes: 1000000000,
 	}
 }
 
@@ -75,51 +81,79 @@ func NewEncoder(opts Dca0Options) (*Dca0Encoder, error) {
 	}, nil
 }
 
-// Sends the individual opus frames as byte arrays through the specified
-// channel.
-// Input can be either a local file or an http(s) address. It can be of any
-// format supported by ffmpeg.
-// Caches the entire opus data due to some problems when reading from ffmpeg
-// too slowly.
-func (e *Dca0Encoder) GetOpusFrames(input string, opts Dca0Options, ch chan<- []byte, errCh chan<- error, cmdCh <-chan Command, respCh chan<- Response) {
-	pcm, cmd, err := getPcm(input, opts.PcmOptions)
+// How far ahead of the encoder a seek may go before ffmpeg is restarted at
+// the target instead of waiting for the encoder to get there.
+const seekAheadSecs = 10
+
+// Decides where a seek to position p goes, given that the frames from first to
+// end are cached; positions are in frames from the start of the track. Returns
+// the new read position, and whether ffmpeg has to be restarted there because
+// it isn't cached and the encoder won't get there soon.
+func seekTo(p, first, end int, encoding, live bool, ahead int) (int, bool) {
+	p = max(p, 0)
+	switch {
+	case live:
+		// Live streams can't be restarted at a position; they can only
+		// go back as far as the frames are kept.
+		return min(max(p, first), end), false
+	case p >= first && p <= end:
+		return p, false
+	case p > end && !encoding:
+		// Past the end of the track.
+		return end, false
+	case p > end && p <= end+ahead:
+		// The encoder is almost there.
+		return p, false
+	}
+	return p, true
+}
+
+// A running ffmpeg and the goroutine encoding its output.
+type encoderRun struct {
+	cmd    *exec.Cmd
+	frames chan []byte   // The encoded frames, closed after the last one.
+	done   chan struct{} // Receives once when the encoder is done.
+	stop   chan struct{} // Closed to tell the encoder to stop.
+}
+
+// Starts ffmpeg at opts.Seek and encodes its output. Only one encoder may run
+// at a time, as they share the opus encoder.
+func (e *Dca0Encoder) startEncoder(input string, opts Dca0Options, errCh chan<- error) (*encoderRun, error) {
+	// The loudness is measured by ffmpeg's loudnorm filter on the way, but
+	// only a measurement of the whole input is of any use.
+	var stderr io.Writer
+	var stats *tailBuffer
+	if opts.OnLoudness != nil && opts.Loudnorm != nil && opts.Loudnorm.Measured == nil && opts.Seek == 0 && !opts.Live {
+		stats = &tailBuffer{max: 8192}
+		stderr = stats
+	}
+	pcm, cmd, err := getPcm(input, opts.PcmOptions, stderr)
 	if err != nil {
-		errCh <- err
-		return
+		return nil, err
+	}
+	run := &encoderRun{
+		cmd:    cmd,
+		frames: make(chan []byte, 8),
+		done:   make(chan struct{}, 1),
+		stop:   make(chan struct{}),
 	}
 
-	// How many opus frames are played per second.
-	framesPerSecond := float32(opts.SampleRate) / float32(opts.FrameSize)
 	// Potential maximum samples an audio frame can have.
 	maxSamples := opts.FrameSize * opts.Channels
 	// One pcm sample equals two bytes.
 	maxBytes := maxSamples * 2
 
-	// Size of the opus frame cache.
-	cacheSize := 0
-	// We're storing all opus frames in this array as a cache.
-	opusFrames := make([][]byte, 0, 512)
-	// Opus frame read position.
-	rp := 0
-	// We're sending frames through this before appending them to opusFrames.
-	frameCh := make(chan []byte, 8)
-
 	sampleBytes := make([]byte, maxBytes)
 	samples := make([]int16, maxSamples)
 
-	// Used by the encoder to tell the main process when it's done encoding.
-	encoderDone := make(chan struct{})
-	// Used by the main process to tell the encoder to stop.
-	encoderStop := make(chan struct{})
-	// Launch the encoder.
-	// Encode opus data and send it through frameCh.
+	// Encode opus data and send it through run.frames.
 	go func() {
 		var killedFfmpeg bool
 	encoderLoop:
 		for {
 			// Stop encoding if the main process tells us to.
 			select {
-			case <-encoderStop:
+			case <-run.stop:
 				// Kill ffmpeg using SIGINT.
 				cmd.Process.Signal(os.Interrupt)
 				pcm.Close()
@@ -157,15 +191,11 @@ func (e *Dca0Encoder) GetOpusFrames(input string, opts Dca0Options, ch chan<- []
 				errCh <- err
 			}
 
-			if cacheSize > opts.MaxCacheBytes {
-				errCh <- &CacheOverflowError{
-					MaxCacheBytes: opts.MaxCacheBytes,
-				}
-				break
+			select {
+			case run.frames <- frame:
+			case <-run.stop:
+				// Handled at the start of the loop.
 			}
-
-			cacheSize += len(frame)
-			frameCh <- frame
 		}
 		// Wait for ffmpeg to close.
 		err = cmd.Wait()
@@ -182,28 +212,98 @@ func (e *Dca0Encoder) GetOpusFrames(input string, opts Dca0Options, ch chan<- []
 			default:
 				errCh <- err
 			}
+		} else if stats != nil && !killedFfmpeg {
+			if m, err := parseLoudnessStats(stats.String()); err == nil {
+				opts.OnLoudness(m)
+			} else {
+				fmt.Printf("Couldn't get the loudness from ffmpeg: %s\n", err)
+			}
 		}
 		// Tell the main process that the encoder is done.
-		encoderDone <- struct{}{}
+		close(run.frames)
+		run.done <- struct{}{}
 	}()
+	return run, nil
+}
+
+// Sends the individual opus frames as byte arrays through the specified
+// channel.
+// Input can be either a local file or an http(s) address. It can be of any
+// format supported by ffmpeg.
+// Caches the opus data due to some problems when reading from ffmpeg too
+// slowly, see frameStore. Seeking outside of the cached frames restarts
+// ffmpeg at the target and starts a new cache there.
+func (e *Dca0Encoder) GetOpusFrames(input string, opts Dca0Options, ch chan<- []byte, errCh chan<- error, cmdCh <-chan Command, respCh chan<- Response) {
+	run, err := e.startEncoder(input, opts, errCh)
+	if err != nil {
+		errCh <- err
+		return
+	}
+
+	// How many opus frames are played per second.
+	framesPerSecond := float32(opts.SampleRate) / float32(opts.FrameSize)
+
+	// We're storing the opus frames as a cache.
+	frames := newFrameStore(opts)
+	defer func() { frames.Close() }()
+	// The position of the first cached frame in the track, i.e. where ffmpeg
+	// was started. Positions (like rp) are in frames from the start of the
+	// track, frames.Get() takes them relative to base.
+	base := int(opts.Seek * framesPerSecond)
+	// Opus frame read position.
+	rp := base
 
 	encoderRunning := true
 	paused := false
 	loop := false
+	// The next frame to send. It is kept until it has been sent, so that it
+	// isn't read from the store again.
+	var next []byte
+
+	// Restarts ffmpeg at position p, discarding the cached frames.
+	restart := func(p int) error {
+		close(run.stop)
+		if encoderRunning {
+			<-run.done
+			encoderRunning = false
+		}
+		frames.Close()
+		opts.Seek = float32(p) / framesPerSecond
+		frames = newFrameStore(opts)
+		base, rp, next = p, p, nil
+		r, err := e.startEncoder(input, opts, errCh)
+		if err != nil {
+			return err
+		}
+		run = r
+		encoderRunning = true
+		return nil
+	}
 
 loop:
 	for {
+		// Frames that weren't played yet are never dropped, so the
+		// encoder waits while the store is full.
+		frames.SetReadPos(rp - base)
+		encoded := run.frames
+		if frames.Full() {
+			encoded = nil
+		}
 		select {
-		case v := <-frameCh:
-			opusFrames = append(opusFrames, v)
-		case <-encoderDone:
-			encoderRunning = false
+		case v, ok := <-encoded:
+			if !ok {
+				// The encoder is done and all of its frames are stored.
+				encoderRunning = false
+				run.frames = nil
+			} else if err := frames.Add(v); err != nil {
+				errCh <- err
+				close(run.stop)
+				break loop
+			}
 		case receivedCmd := <-cmdCh:
 			switch v := receivedCmd.(type) {
 			case CommandStop:
-				if encoderRunning {
-					encoderStop <- struct{}{}
-				}
+				close(run.stop)
 				break loop
 			case CommandPause:
 				paused = true
@@ -214,49 +314,78 @@ loop:
 			case CommandStopLooping:
 				loop = false
 			case CommandSeek:
-				rp = int(float32(v) * framesPerSecond)
+				p, restartAt := seekTo(int(float32(v)*framesPerSecond),
+					base+frames.First(), base+frames.Len(), encoderRunning, opts.Live,
+					int(seekAheadSecs*framesPerSecond))
+				if restartAt {
+					if err := restart(p); err != nil {
+						errCh <- err
+						break loop
+					}
+				}
+				rp, next = p, nil
 			case CommandGetPlaybackTime:
 				respCh <- ResponsePlaybackTime(float32(rp) / framesPerSecond)
 			case CommandGetDuration:
 				if encoderRunning {
 					respCh <- ResponseDurationUnknown{}
 				} else {
-					respCh <- ResponseDuration(float32(len(opusFrames)) / framesPerSecond)
+					respCh <- ResponseDuration(float32(base+frames.Len()) / framesPerSecond)
 				}
 			}
 		default:
 			time.Sleep(2 * time.Millisecond)
 		}
 
-		if !paused && rp < len(opusFrames) {
+		if rp < base+frames.First() {
+			// Paused for longer than a live stream's frames are kept.
+			rp = base + frames.First()
+			next = nil
+		}
+		if !paused && rp < base+frames.Len() {
+			if next == nil {
+				next, err = frames.Get(rp - base)
+				if err != nil {
+					errCh <- err
+					close(run.stop)
+					break loop
+				}
+			}
 			if encoderRunning {
 				select {
-				case ch <- opusFrames[rp]:
+				case ch <- next:
 					rp++
+					next = nil
 				default:
 				}
 			} else {
-				ch <- opusFrames[rp]
+				ch <- next
 				rp++
+				next = nil
 			}
 		}
 
-		if !encoderRunning && rp >= len(opusFrames) {
-			if loop {
-				rp = 0
-			} else {
+		if !encoderRunning && rp >= base+frames.Len() {
+			if !loop {
 				// We're done sending opus data.
 				break
 			}
+			if base+frames.First() == 0 {
+				rp = 0
+			} else if err := restart(0); err != nil {
+				// The start of the track isn't cached.
+				errCh <- err
+				break
+			}
 		}
 	}
 
 	fmt.Println("Theoretically done calling ffmpeg.")
-	fmt.Printf("%s %s\n", cmd.Path, cmd.Args)
+	fmt.Printf("%s %s\n", run.cmd.Path, run.cmd.Args)
 
 	// Wait for the encoder to finish if it's still running.
 	if encoderRunning {
-		<-encoderDone
+		<-run.done
 		encoderRunning = false
 		// TODO: I want to make this unnecessary. I have just noticed that
 		// this channel often get stuck so a panic is more helpful than that.
@@ -0,0 +1,43 @@
+package dca0
+
+import "testing"
+
+func TestSeekTo(t *testing.T) {
+	const ahead = 500
+	tests := []struct {
+		name           string
+		p, first, end  int
+		encoding, live bool
+		want           int
+		wantRestart    bool
+	}{
+		{"cached", 300, 0, 1000, true, false, 300, false},
+		{"start", 0, 0, 1000, true, false, 0, false},
+		{"negative", -50, 0, 1000, true, false, 0, false},
+		{"end of the encoded frames", 1000, 0, 1000, true, false, 1000, false},
+		{"slightly ahead", 1400, 0, 1000, true, false, 1400, false},
+		{"far ahead", 1600, 0, 1000, true, false, 1600, true},
+		{"past the end", 5000, 0, 1000, false, false, 1000, false},
+
+		// After a restart at frame 2000, frames 2000 to 2300 are cached.
+		{"restarted, cached", 2100, 2000, 2300, true, false, 2100, false},
+		{"restarted, before the cache", 1999, 2000, 2300, true, false, 1999, true},
+		{"restarted, to the start", 0, 2000, 2300, true, false, 0, true},
+		{"restarted, slightly ahead", 2800, 2000, 2300, true, false, 2800, false},
+		{"restarted, far ahead", 2801, 2000, 2300, true, false, 2801, true},
+		{"restarted, past the end", 9000, 2000, 2300, false, false, 2300, false},
+		{"restarted, before the cache when done", 100, 2000, 2300, false, false, 100, true},
+
+		// A live stream that only keeps frames 4000 to 5000.
+		{"live, cached", 4500, 4000, 5000, true, true, 4500, false},
+		{"live, before the kept frames", 100, 4000, 5000, true, true, 4000, false},
+		{"live, ahead", 6000, 4000, 5000, true, true, 5000, false},
+	}
+	for _, tt := range tests {
+		got, restart := seekTo(tt.p, tt.first, tt.end, tt.encoding, tt.live, ahead)
+		if got != tt.want || restart != tt.wantRestart {
+			t.Errorf("%s: seekTo(%d, %d, %d) = %d, %t; want %d, %t", tt.name,
+				tt.p, tt.first, tt.end, got, restart, tt.want, tt.wantRestart)
+		}
+	}
+}
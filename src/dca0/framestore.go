@@ -0,0 +1,240 @@
+// Storage of the encoded opus frames of a track.
+package dca0
+
+import (
+	"os"
+)
+
+// frameStore keeps the opus frames of a track, so that it can be seeked and
+// looped. Frames are numbered from 0 in the order they were added. Stores are
+// only used by one goroutine.
+type frameStore interface {
+	Add(frame []byte) error
+	// Returns frame i, which must be between First() and Len().
+	Get(i int) ([]byte, error)
+	// The number of frames added so far.
+	Len() int
+	// The index of the oldest frame still stored.
+	First() int
+	// Sets the index of the next frame to be played. Stores that have to
+	// drop frames only drop the ones before it, except for live streams.
+	SetReadPos(i int)
+	// Reports whether the store can't take more frames without dropping
+	// ones that weren't played yet, so the encoder has to wait.
+	Full() bool
+	Close()
+}
+
+func newFrameStore(opts Dca0Options) frameStore {
+	if opts.Live {
+		return &ringStore{maxBytes: opts.MaxCacheBytes}
+	}
+	return &spillStore{maxBytes: opts.MaxCacheBytes, maxFileBytes: opts.MaxSpillBytes, dir: opts.SpillDir}
+}
+
+// ringStore keeps the most recent frames of live streams, which never end,
+// within maxBytes. Seeking back is possible as far as they go. With
+// keepUnplayed, only frames before the read position are dropped.
+type ringStore struct {
+	maxBytes     int
+	keepUnplayed bool
+	frames       [][]byte
+	first        int
+	size         int
+	readPos      int
+}
+
+func (s *ringStore) Add(frame []byte) error {
+	s.frames = append(s.frames, frame)
+	s.size += len(frame)
+	s.evict()
+	return nil
+}
+
+func (s *ringStore) evict() {
+	for s.size > s.maxBytes && len(s.frames) > 1 && (!s.keepUnplayed || s.first < s.readPos) {
+		s.size -= len(s.frames[0])
+		s.frames[0] = nil
+		s.frames = s.frames[1:]
+		s.first++
+	}
+}
+
+func (s *ringStore) Get(i int) ([]byte, error) {
+	return s.frames[i-s.first], nil
+}
+
+func (s *ringStore) Len() int {
+	return s.first + len(s.frames)
+}
+
+func (s *ringStore) First() int {
+	return s.first
+}
+
+func (s *ringStore) SetReadPos(i int) {
+	s.readPos = i
+	s.evict()
+}
+
+func (s *ringStore) Full() bool {
+	// Whatever could be dropped has been.
+	return s.keepUnplayed && s.size > s.maxBytes
+}
+
+func (s *ringStore) Close() {
+	s.frames = nil
+}
+
+// spillStore keeps all frames, in memory up to maxBytes and in a temporary
+// file in dir after that. Only the offsets of the frames stay in memory, 8
+// bytes per 20ms. Streams that never end without being marked as live would
+// fill the disk, so once the file would grow beyond maxFileBytes, it is
+// removed and only the most recent frames are kept like for live streams,
+// starting with the ones that weren't played yet. Until those fit into
+// maxBytes, the store is full.
+type spillStore struct {
+	maxBytes     int
+	maxFileBytes int64
+	dir          string // "" means the default temporary directory.
+	frames       [][]byte
+	size         int
+	// Once spilled, the file holding all frames and where each of them
+	// starts; the last offset is the end of the file.
+	file     *os.File
+	offsets  []int64
+	maxFrame int // The size of the largest frame in the file.
+	// Once the file is full, the store continues as this.
+	ring    *ringStore
+	readPos int
+}
+
+func (s *spillStore) Add(frame []byte) error {
+	if s.ring != nil {
+		return s.ring.Add(frame)
+	}
+	if s.file == nil {
+		s.frames = append(s.frames, frame)
+		s.size += len(frame)
+		if s.size <= s.maxBytes {
+			return nil
+		}
+		return s.spill()
+	}
+	end := s.offsets[len(s.offsets)-1]
+	if s.maxFileBytes > 0 && end+int64(len(frame)) > s.maxFileBytes {
+		if err := s.fileToRing(); err != nil {
+			return err
+		}
+		return s.ring.Add(frame)
+	}
+	if _, err := s.file.WriteAt(frame, end); err != nil {
+		return err
+	}
+	s.offsets = append(s.offsets, end+int64(len(frame)))
+	s.maxFrame = max(s.maxFrame, len(frame))
+	return nil
+}
+
+// Replaces the file by a ring holding the frames that weren't played yet.
+func (s *spillStore) fileToRing() error {
+	first := min(s.readPos, s.Len())
+	unplayed := make([]byte, s.offsets[len(s.offsets)-1]-s.offsets[first])
+	if _, err := s.file.ReadAt(unplayed, s.offsets[first]); err != nil {
+		return err
+	}
+	ring := &ringStore{maxBytes: s.maxBytes, keepUnplayed: true, first: first, readPos: s.readPos}
+	for i := first; i < s.Len(); i++ {
+		ring.frames = append(ring.frames, unplayed[s.offsets[i]-s.offsets[first]:s.offsets[i+1]-s.offsets[first]])
+	}
+	ring.size = len(unplayed)
+	s.closeFile()
+	s.ring = ring
+	return nil
+}
+
+// Moves the frames from memory into the file.
+func (s *spillStore) spill() error {
+	f, err := os.CreateTemp(s.dir, "dca0-*.opus")
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.offsets = make([]int64, 1, len(s.frames)*2)
+	frames := s.frames
+	s.frames = nil
+	s.size = 0
+	for _, frame := range frames {
+		if err := s.Add(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *spillStore) Get(i int) ([]byte, error) {
+	if s.ring != nil {
+		return s.ring.Get(i)
+	}
+	if s.file == nil {
+		return s.frames[i], nil
+	}
+	frame := make([]byte, s.offsets[i+1]-s.offsets[i])
+	_, err := s.file.ReadAt(frame, s.offsets[i])
+	return frame, err
+}
+
+func (s *spillStore) Len() int {
+	if s.ring != nil {
+		return s.ring.Len()
+	}
+	if s.file == nil {
+		return len(s.frames)
+	}
+	return len(s.offsets) - 1
+}
+
+func (s *spillStore) First() int {
+	if s.ring != nil {
+		return s.ring.First()
+	}
+	return 0
+}
+
+func (s *spillStore) SetReadPos(i int) {
+	s.readPos = i
+	if s.ring != nil {
+		s.ring.SetReadPos(i)
+	}
+}
+
+func (s *spillStore) Full() bool {
+	if s.ring != nil {
+		return s.ring.Full()
+	}
+	if s.file == nil || s.maxFileBytes <= 0 {
+		return false
+	}
+	// Only once the next frame may not fit into the file anymore, the
+	// frames that weren't played yet have to fit into memory.
+	end := s.offsets[len(s.offsets)-1]
+	unplayed := end - s.offsets[min(s.readPos, s.Len())]
+	return end+int64(s.maxFrame) > s.maxFileBytes && unplayed > int64(s.maxBytes)
+}
+
+func (s *spillStore) Close() {
+	s.frames = nil
+	s.closeFile()
+	if s.ring != nil {
+		s.ring.Close()
+	}
+}
+
+func (s *spillStore) closeFile() {
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+		s.offsets = nil
+	}
+}
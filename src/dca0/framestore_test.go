@@ -0,0 +1,170 @@
+package dca0
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+// Returns frame i of a test track: size bytes, all with the value i.
+func testFrame(i, size int) []byte {
+	return bytes.Repeat([]byte{byte(i)}, size)
+}
+
+func addFrames(t *testing.T, s frameStore, from, to, size int) {
+	t.Helper()
+	for i := from; i < to; i++ {
+		if err := s.Add(testFrame(i, size)); err != nil {
+			t.Fatalf("Add(%d): %s", i, err)
+		}
+	}
+}
+
+// Checks that the store holds exactly the frames from first to end.
+func checkFrames(t *testing.T, s frameStore, first, end, size int) {
+	t.Helper()
+	if s.First() != first || s.Len() != end {
+		t.Fatalf("store holds frames %d to %d, want %d to %d", s.First(), s.Len(), first, end)
+	}
+	for i := first; i < end; i++ {
+		frame, err := s.Get(i)
+		if err != nil {
+			t.Fatalf("Get(%d): %s", i, err)
+		}
+		if !bytes.Equal(frame, testFrame(i, size)) {
+			t.Fatalf("Get(%d) returned the wrong frame", i)
+		}
+	}
+}
+
+func checkDirEmpty(t *testing.T, dir string) {
+	t.Helper()
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Fatalf("%d files are left in the spill directory", len(files))
+	}
+}
+
+func TestRingStoreEvictsOldestFrames(t *testing.T) {
+	s := &ringStore{maxBytes: 35}
+	addFrames(t, s, 0, 3, 10)
+	checkFrames(t, s, 0, 3, 10)
+	addFrames(t, s, 3, 10, 10)
+	checkFrames(t, s, 7, 10, 10)
+	s.Close()
+}
+
+func TestRingStoreKeepsLargeFrame(t *testing.T) {
+	s := &ringStore{maxBytes: 5}
+	addFrames(t, s, 0, 4, 10)
+	checkFrames(t, s, 3, 4, 10)
+}
+
+func TestSpillStoreInMemory(t *testing.T) {
+	dir := t.TempDir()
+	s := &spillStore{maxBytes: 100, dir: dir}
+	addFrames(t, s, 0, 10, 10)
+	checkFrames(t, s, 0, 10, 10)
+	checkDirEmpty(t, dir)
+	s.Close()
+}
+
+func TestSpillStoreSpills(t *testing.T) {
+	dir := t.TempDir()
+	s := &spillStore{maxBytes: 100, dir: dir}
+	// Frames 0 to 9 fit into memory, 10 spills them and 11 to 19 are
+	// written to the file directly.
+	addFrames(t, s, 0, 20, 10)
+	if s.file == nil {
+		t.Fatal("store didn't spill")
+	}
+	checkFrames(t, s, 0, 20, 10)
+	// Frames of different sizes across the spill boundary.
+	s2 := &spillStore{maxBytes: 100, dir: dir}
+	for i := 0; i < 20; i++ {
+		if err := s2.Add(testFrame(i, i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i++ {
+		frame, err := s2.Get(i)
+		if err != nil || !bytes.Equal(frame, testFrame(i, i+1)) {
+			t.Fatalf("Get(%d) returned the wrong frame: %v", i, err)
+		}
+	}
+
+	s.Close()
+	s2.Close()
+	checkDirEmpty(t, dir)
+}
+
+func TestSpillStoreFileLimit(t *testing.T) {
+	dir := t.TempDir()
+	s := &spillStore{maxBytes: 50, maxFileBytes: 200, dir: dir}
+	addFrames(t, s, 0, 20, 10)
+	checkFrames(t, s, 0, 20, 10)
+	// Frame 20 doesn't fit into the file anymore, so only the most recent
+	// frames are kept from now on. Every frame is played right away.
+	for i := 20; i < 30; i++ {
+		s.SetReadPos(i)
+		addFrames(t, s, i, i+1, 10)
+	}
+	s.SetReadPos(30)
+	if s.file != nil {
+		t.Fatal("the file wasn't removed")
+	}
+	checkDirEmpty(t, dir)
+	checkFrames(t, s, 25, 30, 10)
+	s.Close()
+}
+
+func TestSpillStoreFileLimitKeepsUnplayedFrames(t *testing.T) {
+	dir := t.TempDir()
+	s := &spillStore{maxBytes: 50, maxFileBytes: 200, dir: dir}
+	// The encoder is faster than playback: it adds up to 3 frames for every
+	// frame played, unless the store is full.
+	const n = 100
+	added := 0
+	for played := 0; played < n; played++ {
+		for i := 0; i < 3 && added < n && !s.Full(); i++ {
+			addFrames(t, s, added, added+1, 10)
+			added++
+		}
+		if played >= s.Len() {
+			t.Fatalf("frame %d wasn't added", played)
+		}
+		if played < s.First() {
+			t.Fatalf("frame %d was dropped before it was played", played)
+		}
+		frame, err := s.Get(played)
+		if err != nil || !bytes.Equal(frame, testFrame(played, 10)) {
+			t.Fatalf("Get(%d) returned the wrong frame: %v", played, err)
+		}
+		s.SetReadPos(played + 1)
+		if s.ring != nil && s.ring.size > s.maxBytes+10 {
+			t.Fatalf("%d bytes are kept in memory", s.ring.size)
+		}
+	}
+	if s.file != nil {
+		t.Fatal("the file wasn't removed")
+	}
+	checkDirEmpty(t, dir)
+	s.Close()
+}
+
+func TestRingStoreKeepsUnplayedFrames(t *testing.T) {
+	s := &ringStore{maxBytes: 35, keepUnplayed: true}
+	addFrames(t, s, 0, 5, 10)
+	if !s.Full() {
+		t.Fatal("store isn't full")
+	}
+	checkFrames(t, s, 0, 5, 10)
+	s.SetReadPos(3)
+	if s.Full() {
+		t.Fatal("store is still full")
+	}
+	checkFrames(t, s, 2, 5, 10)
+}
@@ -0,0 +1,24 @@
+// Volume adjustment of pcm frames.
+package dca0
+
+import (
+	"math"
+)
+
+// Samples louder than this fraction of full scale are compressed instead of
+// clipped hard, which would sound harsh.
+const softClipKnee = 0.8
+
+// Converts a sample to int16, compressing peaks above the knee smoothly
+// towards full scale.
+func softClip(v float64) int16 {
+	const knee = softClipKnee * math.MaxInt16
+	const headroom = math.MaxInt16 - knee
+	switch {
+	case v > knee:
+		v = knee + headroom*math.Tanh((v-knee)/headroom)
+	case v < -knee:
+		v = -knee - headroom*math.Tanh((-v-knee)/headroom)
+	}
+	return int16(math.Round(v))
+}
@@ -0,0 +1,41 @@
+package dca0
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSoftClip(t *testing.T) {
+	const knee = softClipKnee * math.MaxInt16
+	tests := []struct {
+		v    float64
+		want int16
+	}{
+		{0, 0},
+		{1000.4, 1000},
+		{-1000.6, -1001},
+		{knee, int16(math.Round(knee))},
+		{-knee, -int16(math.Round(knee))},
+		{1e9, math.MaxInt16},
+		{-1e9, -math.MaxInt16},
+	}
+	for _, tt := range tests {
+		if got := softClip(tt.v); got != tt.want {
+			t.Errorf("softClip(%g) = %d, want %d", tt.v, got, tt.want)
+		}
+	}
+
+	// Above the knee, louder samples stay louder, but never reach the
+	// limit before it.
+	prev := softClip(knee)
+	for v := knee + 1000; v < 3*math.MaxInt16; v += 1000 {
+		got := softClip(v)
+		if got < prev || got > math.MaxInt16 {
+			t.Fatalf("softClip(%g) = %d after %d", v, got, prev)
+		}
+		if v < math.MaxInt16 && float64(got) >= v {
+			t.Fatalf("softClip(%g) = %d isn't compressed", v, got)
+		}
+		prev = got
+	}
+}
@@ -0,0 +1,123 @@
+// Loudness normalization (EBU R128) with ffmpeg's loudnorm filter.
+package dca0
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+type LoudnormOptions struct {
+	Target   float64 // Integrated loudness in LUFS, e.g. -16.
+	TruePeak float64 // Maximum true peak in dBTP, e.g. -1.5.
+	Range    float64 // Loudness range in LU, e.g. 11.
+	// The loudness of the input as measured by MeasureLoudness. If it is
+	// set, the gain is applied linearly (two-pass normalization). Otherwise
+	// loudnorm adjusts the gain dynamically while playing, which works
+	// without knowing the whole input but sounds less natural.
+	Measured *LoudnessMeasurement
+}
+
+func GetDefaultLoudnormOptions(target float64) LoudnormOptions {
+	return LoudnormOptions{
+		Target:   target,
+		TruePeak: -1.5,
+		Range:    11,
+	}
+}
+
+// LoudnessMeasurement is the result of the first loudnorm pass.
+type LoudnessMeasurement struct {
+	I         float64 `json:"i"`
+	TruePeak  float64 `json:"true_peak"`
+	Range     float64 `json:"range"`
+	Threshold float64 `json:"threshold"`
+	Offset    float64 `json:"offset"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// Returns the ffmpeg audio filter normalizing to the options.
+func LoudnormFilter(opts LoudnormOptions) string {
+	filter := "loudnorm=I=" + formatFloat(opts.Target) +
+		":TP=" + formatFloat(opts.TruePeak) +
+		":LRA=" + formatFloat(opts.Range)
+	if m := opts.Measured; m != nil {
+		filter += ":measured_I=" + formatFloat(m.I) +
+			":measured_TP=" + formatFloat(m.TruePeak) +
+			":measured_LRA=" + formatFloat(m.Range) +
+			":measured_thresh=" + formatFloat(m.Threshold) +
+			":offset=" + formatFloat(m.Offset) +
+			":linear=true"
+	}
+	return filter
+}
+
+// Measures the loudness of the input by decoding all of it. Input can be
+// either a local file or an http(s) address.
+func MeasureLoudness(ctx context.Context, ffmpegPath string, input string, opts LoudnormOptions) (*LoudnessMeasurement, error) {
+	opts.Measured = nil
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-hide_banner",
+		"-nostats",
+		"-vn", "-sn", "-dn",
+		"-i", input,
+		"-af", LoudnormFilter(opts)+":print_format=json",
+		"-f", "null",
+		"-")
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w", err)
+	}
+	return parseLoudnessStats(stderr.String())
+}
+
+// Parses the statistics ffmpeg's loudnorm filter prints with
+// print_format=json as the last JSON object of its output.
+func parseLoudnessStats(out string) (*LoudnessMeasurement, error) {
+	start, end := strings.LastIndex(out, "{"), strings.LastIndex(out, "}")
+	if start < 0 || end < start {
+		return nil, errors.New("ffmpeg didn't print loudness statistics")
+	}
+	var stats struct {
+		InputI      string `json:"input_i"`
+		InputTP     string `json:"input_tp"`
+		InputLRA    string `json:"input_lra"`
+		InputThresh string `json:"input_thresh"`
+		Offset      string `json:"target_offset"`
+	}
+	if err := json.Unmarshal([]byte(out[start:end+1]), &stats); err != nil {
+		return nil, fmt.Errorf("invalid loudness statistics: %w", err)
+	}
+	var m LoudnessMeasurement
+	for _, v := range []struct {
+		s string
+		f *float64
+	}{
+		{stats.InputI, &m.I},
+		{stats.InputTP, &m.TruePeak},
+		{stats.InputLRA, &m.Range},
+		{stats.InputThresh, &m.Threshold},
+		{stats.Offset, &m.Offset},
+	} {
+		f, err := strconv.ParseFloat(v.s, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid loudness statistics: %w", err)
+		}
+		// Silence measures as -inf.
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return nil, errors.New("the input is silent")
+		}
+		*v.f = f
+	}
+	return &m, nil
+}
@@ -0,0 +1,65 @@
+package dca0
+
+import (
+	"strings"
+	"testing"
+)
+
+// What ffmpeg prints with print_format=json, after its usual log output.
+const testLoudnormOutput = `Input #0, ogg, from 'herald.opus':
+  Duration: 00:00:03.02, start: 0.000000, bitrate: 77 kb/s
+  Stream #0:0: Audio: opus, 48000 Hz, stereo, fltp
+Stream mapping:
+  Stream #0:0 -> #0:0 (opus (native) -> pcm_s16le (native))
+[Parsed_loudnorm_0 @ 0x5581c6d0e3c0] 
+{
+	"input_i" : "-23.54",
+	"input_tp" : "-5.21",
+	"input_lra" : "3.80",
+	"input_thresh" : "-33.91",
+	"output_i" : "-16.02",
+	"output_tp" : "-1.50",
+	"output_lra" : "3.10",
+	"output_thresh" : "-26.38",
+	"normalization_type" : "dynamic",
+	"target_offset" : "0.02"
+}
+`
+
+func TestParseLoudnessStats(t *testing.T) {
+	m, err := parseLoudnessStats(testLoudnormOutput)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := LoudnessMeasurement{I: -23.54, TruePeak: -5.21, Range: 3.8, Threshold: -33.91, Offset: 0.02}
+	if *m != want {
+		t.Errorf("got %+v, want %+v", *m, want)
+	}
+
+	// Braces in the log before the statistics don't matter.
+	if _, err := parseLoudnessStats("Metadata: {title}\n" + testLoudnormOutput); err != nil {
+		t.Errorf("statistics after other braces: %v", err)
+	}
+}
+
+func TestParseLoudnessStatsErrors(t *testing.T) {
+	truncated := testLoudnormOutput[:strings.Index(testLoudnormOutput, `"output_i"`)]
+	tests := []struct {
+		name string
+		out  string
+	}{
+		{"no output", ""},
+		{"no statistics", "Input #0, ogg, from 'herald.opus':\nConversion failed!\n"},
+		{"truncated", truncated},
+		{"truncated after other braces", "Metadata: {title}\n" + truncated},
+		{"missing field", strings.Replace(testLoudnormOutput, `"input_tp" : "-5.21",`, "", 1)},
+		{"invalid number", strings.Replace(testLoudnormOutput, `"-23.54"`, `"loud"`, 1)},
+		{"not JSON", "{ input_i: -23.54 }"},
+		{"silence", strings.Replace(testLoudnormOutput, `"-23.54"`, `"-inf"`, 1)},
+	}
+	for _, tt := range tests {
+		if m, err := parseLoudnessStats(tt.out); err == nil {
+			t.Errorf("%s: got %+v, want an error", tt.name, *m)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+// Mixing of overlays such as announcements on top of music.
+package dca0
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"layeh.com/gopus"
+)
+
+// How long the music stays ducked after an overlay ended, so that it doesn't
+// come back up between two clips of the same announcement.
+const duckHold = 500 * time.Millisecond
+
+// How long it takes to duck the music and to bring it back up. Changing the
+// gain abruptly would be audible as a click.
+const (
+	duckAttack  = 60 * time.Millisecond
+	duckRelease = 250 * time.Millisecond
+)
+
+// Mixer is the only thing sending audio to a voice connection. Music is sent
+// to it as opus frames (e.g. by GetOpusFrames) and overlays as pcm frames.
+// Music comes as opus rather than pcm because GetOpusFrames caches the
+// encoded track for seeking and looping, which would take ten times the space
+// as pcm. The mixer decodes every music frame once; as long as there are no
+// overlays and the music volume is 1, the frames are passed through unchanged.
+// Otherwise, the decoded music is turned down or up, ducked, mixed with the
+// overlay and encoded a second time.
+type Mixer struct {
+	opts    Dca0Options
+	music   chan []byte
+	overlay chan []int16
+	out     chan []byte
+	errCh   chan<- error
+
+	mGain       sync.Mutex
+	musicGain   float64
+	duckGain    float64 // Linear gain of the music during overlays.
+	overlayGain float64
+
+	enc *gopus.Encoder
+	dec *gopus.Decoder
+}
+
+// Creates a mixer and starts it. Errors are sent to errCh if it is ready to
+// receive them, they never stop the mixer.
+func NewMixer(opts Dca0Options, duckDb float64, errCh chan<- error) (*Mixer, error) {
+	enc, err := gopus.NewEncoder(opts.SampleRate, opts.Channels, gopus.Audio)
+	if err != nil {
+		return nil, err
+	}
+	enc.SetBitrate(opts.Bitrate)
+	dec, err := gopus.NewDecoder(opts.SampleRate, opts.Channels)
+	if err != nil {
+		return nil, err
+	}
+	m := &Mixer{
+		opts: opts,
+		// Buffered, as GetOpusFrames doesn't wait for us while it is
+		// still encoding.
+		music:   make(chan []byte, 4),
+		overlay: make(chan []int16, 4),
+		out:     make(chan []byte),
+		errCh:   errCh,
+		enc:     enc,
+		dec:     dec,
+
+		musicGain:   1,
+		overlayGain: 1,
+	}
+	m.SetDuck(duckDb)
+	go m.run()
+	return m, nil
+}
+
+// The channel music opus frames are sent to.
+func (m *Mixer) Music() chan<- []byte {
+	return m.music
+}
+
+// The channel overlay pcm frames are sent to. Frames must have
+// FrameSize * Channels samples; shorter ones are padded with silence.
+func (m *Mixer) Overlay() chan<- []int16 {
+	return m.overlay
+}
+
+// The mixed opus frames. They have to be read in real time, e.g. by sending
+// them to a voice connection, which also paces the mixer.
+func (m *Mixer) Output() <-chan []byte {
+	return m.out
+}
+
+// Sets by how many dB the music is lowered during overlays.
+func (m *Mixer) SetDuck(db float64) {
+	m.mGain.Lock()
+	m.duckGain = math.Pow(10, -math.Abs(db)/20)
+	m.mGain.Unlock()
+}
+
+// Sets the volume of the music, 1 being its original volume.
+func (m *Mixer) SetMusicVolume(volume float64) {
+	m.mGain.Lock()
+	m.musicGain = volume
+	m.mGain.Unlock()
+}
+
+// Sets the volume of overlays, 1 being their original volume.
+func (m *Mixer) SetOverlayVolume(volume float64) {
+	m.mGain.Lock()
+	m.overlayGain = volume
+	m.mGain.Unlock()
+}
+
+// Drops music frames that haven't been mixed yet, e.g. after the track was
+// stopped.
+func (m *Mixer) FlushMusic() {
+	for {
+		select {
+		case <-m.music:
+		default:
+			return
+		}
+	}
+}
+
+// ducker decides how far the music is ducked, frame by frame: it goes down
+// over duckAttack once an overlay starts, and back up over duckRelease once
+// there was none for duckHold.
+type ducker struct {
+	holdFrames  int
+	attackStep  float64
+	releaseStep float64
+	// How far the music is ducked, from 0 (not at all) to 1 (by duckGain).
+	duck float64
+	// Frames since the last overlay frame.
+	sinceOverlay int
+}
+
+func newDucker(frameDuration time.Duration) *ducker {
+	holdFrames := int(duckHold / frameDuration)
+	return &ducker{
+		holdFrames:   holdFrames,
+		attackStep:   float64(frameDuration) / float64(duckAttack),
+		releaseStep:  float64(frameDuration) / float64(duckRelease),
+		sinceOverlay: holdFrames,
+	}
+}
+
+// Moves on by one frame, which has an overlay or not. Returns how far the music
+// is ducked at the start and at the end of the frame.
+func (d *ducker) next(overlay bool) (from, to float64) {
+	if overlay {
+		d.sinceOverlay = 0
+	} else if d.sinceOverlay < d.holdFrames {
+		d.sinceOverlay++
+	}
+	from = d.duck
+	if d.sinceOverlay < d.holdFrames {
+		d.duck = math.Min(1, d.duck+d.attackStep)
+	} else {
+		d.duck = math.Max(0, d.duck-d.releaseStep)
+	}
+	return from, d.duck
+}
+
+func (m *Mixer) run() {
+	frameDuration := time.Second * time.Duration(m.opts.FrameSize) / time.Duration(m.opts.SampleRate)
+	ducker := newDucker(frameDuration)
+	maxBytes := m.opts.FrameSize * m.opts.Channels * 2
+	mixed := make([]int16, m.opts.FrameSize*m.opts.Channels)
+	// The music volume at the end of the last frame.
+	prevMusicGain := 1.0
+
+	for {
+		var musicFrame []byte
+		var overlayFrame []int16
+		select {
+		case musicFrame = <-m.music:
+		default:
+		}
+		select {
+		case overlayFrame = <-m.overlay:
+		default:
+		}
+		if musicFrame == nil && overlayFrame == nil {
+			// Nothing is playing, wait for something.
+			select {
+			case musicFrame = <-m.music:
+			case overlayFrame = <-m.overlay:
+			}
+		}
+
+		prevDuck, duck := ducker.next(overlayFrame != nil)
+		m.mGain.Lock()
+		musicGain, duckGain, overlayGain := m.musicGain, m.duckGain, m.overlayGain
+		m.mGain.Unlock()
+		fromMusicGain := prevMusicGain
+		prevMusicGain = musicGain
+
+		var pcm []int16
+		if musicFrame != nil {
+			// Decode every frame, so that the decoder's state is right once
+			// it is needed.
+			var err error
+			pcm, err = m.dec.Decode(musicFrame, m.opts.FrameSize, false)
+			if err != nil {
+				m.sendErr(err)
+				pcm = nil
+			}
+			if overlayFrame == nil && duck == 0 && prevDuck == 0 && musicGain == 1 && fromMusicGain == 1 {
+				m.out <- musicFrame
+				continue
+			}
+		}
+
+		// Ramp the gain over the frame, volume changes would click
+		// otherwise.
+		from := fromMusicGain * (1 - prevDuck*(1-duckGain))
+		to := musicGain * (1 - duck*(1-duckGain))
+		for i := range mixed {
+			var v float64
+			if i < len(pcm) {
+				gain := from + (to-from)*float64(i)/float64(len(mixed))
+				v = float64(pcm[i]) * gain
+			}
+			if i < len(overlayFrame) {
+				v += float64(overlayFrame[i]) * overlayGain
+			}
+			mixed[i] = softClip(v)
+		}
+		frame, err := m.enc.Encode(mixed, m.opts.FrameSize, maxBytes)
+		if err != nil {
+			m.sendErr(err)
+			continue
+		}
+		m.out <- frame
+	}
+}
+
+func (m *Mixer) sendErr(err error) {
+	select {
+	case m.errCh <- err:
+	default:
+	}
+}
@@ -0,0 +1,191 @@
+package dca0
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"layeh.com/gopus"
+)
+
+func TestDuckerRamp(t *testing.T) {
+	d := newDucker(20 * time.Millisecond)
+	step := func(overlay bool, wantFrom, wantTo float64) {
+		t.Helper()
+		from, to := d.next(overlay)
+		if math.Abs(from-wantFrom) > 1e-9 || math.Abs(to-wantTo) > 1e-9 {
+			t.Fatalf("ducked from %g to %g, want %g to %g", from, to, wantFrom, wantTo)
+		}
+	}
+
+	step(false, 0, 0)
+	// The attack takes 3 frames.
+	step(true, 0, 1.0/3)
+	step(true, 1.0/3, 2.0/3)
+	step(true, 2.0/3, 1)
+	step(true, 1, 1)
+	// The music stays ducked for 25 frames after the last overlay frame.
+	for i := 1; i < 25; i++ {
+		step(false, 1, 1)
+	}
+	// And comes back up over 12.5 frames.
+	step(false, 1, 0.92)
+	for i := 0; i < 11; i++ {
+		d.next(false)
+	}
+	step(false, 0.04, 0)
+	step(false, 0, 0)
+
+	// A new overlay during the release ducks again right away.
+	d.next(true)
+	for i := 0; i < 27; i++ {
+		d.next(false)
+	}
+	step(true, 0.76, 1)
+}
+
+// Returns a frame of a 440Hz tone with the given amplitude.
+func testTone(opts Dca0Options, n int, amplitude float64) []int16 {
+	pcm := make([]int16, opts.FrameSize*opts.Channels)
+	for i := 0; i < opts.FrameSize; i++ {
+		t := float64(n*opts.FrameSize+i) / float64(opts.SampleRate)
+		for c := 0; c < opts.Channels; c++ {
+			pcm[i*opts.Channels+c] = int16(amplitude * math.Sin(2*math.Pi*440*t))
+		}
+	}
+	return pcm
+}
+
+func rms(pcm []int16) float64 {
+	var sum float64
+	for _, s := range pcm {
+		sum += float64(s) * float64(s)
+	}
+	return math.Sqrt(sum / float64(len(pcm)))
+}
+
+// Encodes frames of a tone, as GetOpusFrames would send them.
+func testMusic(t *testing.T, opts Dca0Options, n int) [][]byte {
+	enc, err := gopus.NewEncoder(opts.SampleRate, opts.Channels, gopus.Audio)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetBitrate(opts.Bitrate)
+	var frames [][]byte
+	for i := 0; i < n; i++ {
+		frame, err := enc.Encode(testTone(opts, i, 8000), opts.FrameSize, opts.FrameSize*opts.Channels*2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func TestMixerPassesMusicThrough(t *testing.T) {
+	opts := GetDefaultOptions("ffmpeg")
+	m, err := NewMixer(opts, 12, make(chan error))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, frame := range testMusic(t, opts, 10) {
+		m.Music() <- frame
+		if out := <-m.Output(); !bytes.Equal(out, frame) {
+			t.Fatalf("frame %d was changed", i)
+		}
+	}
+}
+
+func TestMixerDucksMusic(t *testing.T) {
+	opts := GetDefaultOptions("ffmpeg")
+	m, err := NewMixer(opts, 12, make(chan error))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := gopus.NewDecoder(opts.SampleRate, opts.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	music := testMusic(t, opts, 40)
+	silence := make([]int16, opts.FrameSize*opts.Channels)
+
+	// Wait until the mixer is blocked on the first frame, so that the
+	// following music and overlay frames are mixed in pairs.
+	m.Music() <- music[0]
+	for i := 1; i < 4; i++ {
+		m.Overlay() <- silence
+		m.Music() <- music[i]
+	}
+	var levels []float64
+	for i := 0; i < len(music); i++ {
+		out := <-m.Output()
+		if i+4 < len(music) {
+			m.Overlay() <- silence
+			m.Music() <- music[i+4]
+		}
+		pcm, err := dec.Decode(out, opts.FrameSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		levels = append(levels, rms(pcm))
+	}
+
+	// Once ducked, the music is 12dB lower, which is a gain of about 0.25.
+	ref, err := gopus.NewDecoder(opts.SampleRate, opts.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var full float64
+	for _, frame := range music[:10] {
+		pcm, err := ref.Decode(frame, opts.FrameSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		full = rms(pcm)
+	}
+	for i, level := range levels[5:] {
+		if ratio := level / full; ratio < 0.2 || ratio > 0.3 {
+			t.Fatalf("frame %d is at %.2f of the full level, want about 0.25", i+5, ratio)
+		}
+	}
+}
+
+func TestMixerMusicVolume(t *testing.T) {
+	opts := GetDefaultOptions("ffmpeg")
+	m, err := NewMixer(opts, 12, make(chan error))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dec, err := gopus.NewDecoder(opts.SampleRate, opts.Channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	music := testMusic(t, opts, 30)
+	var levels []float64
+	for i, frame := range music {
+		if i == 10 {
+			m.SetMusicVolume(0.5)
+		}
+		if i == 20 {
+			m.SetMusicVolume(1)
+		}
+		m.Music() <- frame
+		out := <-m.Output()
+		// Back at the original volume, frames are passed through again.
+		if (i < 10 || i > 20) != bytes.Equal(out, frame) {
+			t.Fatalf("frame %d was passed through: %t", i, bytes.Equal(out, frame))
+		}
+		pcm, err := dec.Decode(out, opts.FrameSize, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		levels = append(levels, rms(pcm))
+	}
+	// The encoder needs a few frames to settle.
+	for i := 15; i < 20; i++ {
+		if ratio := levels[i] / levels[9]; ratio < 0.4 || ratio > 0.6 {
+			t.Fatalf("frame %d is at %.2f of the full level, want about 0.5", i, ratio)
+		}
+	}
+}
@@ -13,7 +13,8 @@ type PcmOptions struct {
 	FfmpegPath string
 	Channels   int
 	SampleRate int
-	Seek       float32 // Seek means where to start in seconds.
+	Loudnorm   *LoudnormOptions // If set, the loudness is normalized.
+	Seek       float32          // Seek means where to start in seconds.
 	Duration   float32
 	// Duration means where to stop (in seconds after the time specified by Seek).
 	// If Duration is set to 0, the stream will ignore it and encode all the way
@@ -34,8 +35,10 @@ func getDefaultPcmOptions(ffmpegPath string) PcmOptions {
 // Input can be either a local file or an http(s) address. It can be of any
 // audio format supported by ffmpeg.
 // Wait must be called on the returned command to free its resources after
-// everything has been read.
-func getPcm(input string, opts PcmOptions) (io.ReadCloser, *exec.Cmd, error) {
+// everything has been read. ffmpeg's messages are written to stderr, if it
+// isn't nil; when normalizing dynamically, they end with the loudness of the
+// input.
+func getPcm(input string, opts PcmOptions, stderr io.Writer) (io.ReadCloser, *exec.Cmd, error) {
 	if input == "" {
 		return nil, nil, errors.New("dca0.getPcm() called with empty input")
 	}
@@ -44,6 +47,7 @@ func getPcm(input string, opts PcmOptions) (io.ReadCloser, *exec.Cmd, error) {
 		"-vn", // No video.
 		"-sn", // No subtitle.
 		"-dn", // No data encoding.
+		"-nostats",
 	}...)
 	if opts.Seek != 0.0 {
 		cmdOpts = append(cmdOpts,
@@ -54,8 +58,15 @@ func getPcm(input string, opts PcmOptions) (io.ReadCloser, *exec.Cmd, error) {
 		cmdOpts = append(cmdOpts,
 			"-t", strconv.FormatFloat(float64(opts.Duration), 'f', 5, 32))
 	}
+	cmdOpts = append(cmdOpts, "-i", input)
+	if opts.Loudnorm != nil {
+		filter := LoudnormFilter(*opts.Loudnorm)
+		if opts.Loudnorm.Measured == nil {
+			filter += ":print_format=json"
+		}
+		cmdOpts = append(cmdOpts, "-af", filter)
+	}
 	cmdOpts = append(cmdOpts, []string{
-		"-i", input,
 		"-f", "s16le", // Signed int16 samples.
 		"-ar", strconv.Itoa(opts.SampleRate),
 		"-ac", strconv.Itoa(opts.Channels), // Number of audio channels.
@@ -63,6 +74,7 @@ func getPcm(input string, opts PcmOptions) (io.ReadCloser, *exec.Cmd, error) {
 	}...)
 	cmd := exec.Command(opts.FfmpegPath, cmdOpts...)
 	fmt.Printf("ffmpeg command: %s %s\n", cmd.Path, cmd.Args)
+	cmd.Stderr = stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, nil, err
@@ -73,3 +85,21 @@ func getPcm(input string, opts PcmOptions) (io.ReadCloser, *exec.Cmd, error) {
 	fmt.Println("Seemingly called ffmpeg successfully?")
 	return stdout, cmd, nil
 }
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.max:]...)
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
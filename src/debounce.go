@@ -0,0 +1,128 @@
+// Suppresses announcements of users with flaky connections.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Clock is the source of time for the announcement queue. It exists so that
+// windows, flaps and cooldowns can be driven by a fake clock instead of
+// sleeping.
+type Clock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+type Timer interface {
+	Stop() bool
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return time.AfterFunc(d, f)
+}
+
+// A leave that is held back in case the user rejoins.
+type heldLeave struct {
+	ann   *Announcement
+	timer Timer
+	// When the user was last announced before the leave, so that a
+	// suppressed flap doesn't count towards the cooldown.
+	prevLast time.Time
+}
+
+// Debouncer sits in front of the announcement queue. Leaves are held back for
+// the flap window and dropped together with the rejoin if the user comes back
+// in time. After a user has been announced, further events of that user are
+// suppressed until the cooldown has passed. All suppressed events are logged at
+// debug level.
+type Debouncer struct {
+	sync.Mutex
+	clock Clock
+	// Called with every announcement that makes it through.
+	emit func(*Announcement)
+	held map[string]*heldLeave // User ID to held back leave.
+	last map[string]time.Time  // User ID to time of the last announcement.
+}
+
+func NewDebouncer(clock Clock, emit func(*Announcement)) *Debouncer {
+	return &Debouncer{
+		clock: clock,
+		emit:  emit,
+		held:  make(map[string]*heldLeave),
+		last:  make(map[string]time.Time),
+	}
+}
+
+// Offers an announcement to the debouncer. A flap window or cooldown of 0
+// disables the respective check.
+func (d *Debouncer) Offer(ann *Announcement, flapWindow, cooldown time.Duration) {
+	d.Lock()
+	now := d.clock.Now()
+
+	if ann.Event == announceJoin {
+		if h, ok := d.held[ann.UserID]; ok {
+			h.timer.Stop()
+			delete(d.held, ann.UserID)
+			d.last[ann.UserID] = h.prevLast
+			d.Unlock()
+			logger.Debug("Suppressing leave followed by rejoin",
+				zap.String("user", ann.Data.Username),
+				zap.Duration("flapWindow", flapWindow),
+			)
+			return
+		}
+	}
+
+	if last, ok := d.last[ann.UserID]; ok && cooldown > 0 && now.Sub(last) < cooldown {
+		d.Unlock()
+		logger.Debug("Suppressing announcement during cooldown",
+			zap.String("user", ann.Data.Username),
+			zap.String("event", ann.Event.String()),
+			zap.Duration("remaining", cooldown-now.Sub(last)),
+		)
+		return
+	}
+
+	prevLast := d.last[ann.UserID]
+	d.last[ann.UserID] = now
+
+	if ann.Event == announceLeave && flapWindow > 0 {
+		h := &heldLeave{
+			ann:      ann,
+			prevLast: prevLast,
+		}
+		h.timer = d.clock.AfterFunc(flapWindow, func() {
+			d.release(ann.UserID, h)
+		})
+		d.held[ann.UserID] = h
+		d.Unlock()
+		return
+	}
+	d.Unlock()
+
+	d.emit(ann)
+}
+
+// Passes on a held back leave once its flap window has passed without a
+// rejoin.
+func (d *Debouncer) release(userID string, h *heldLeave) {
+	d.Lock()
+	if d.held[userID] != h {
+		// Already suppressed by a rejoin.
+		d.Unlock()
+		return
+	}
+	delete(d.held, userID)
+	d.Unlock()
+
+	d.emit(h.ann)
+}
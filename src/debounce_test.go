@@ -0,0 +1,194 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	logger = zap.NewNop()
+	currentConfig.Store(&Config{})
+	os.Exit(m.Run())
+}
+
+// fakeClock only moves when Advance is called, which runs the timers that are
+// due in order.
+type fakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c       *fakeClock
+	at      time.Time
+	f       func()
+	stopped bool
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakeTimer{c: c, at: c.now.Add(d), f: f}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := !t.stopped
+	t.stopped = true
+	return wasActive
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	sort.SliceStable(c.timers, func(i, j int) bool { return c.timers[i].at.Before(c.timers[j].at) })
+	var due []*fakeTimer
+	var pending []*fakeTimer
+	for _, t := range c.timers {
+		switch {
+		case t.stopped:
+		case !t.at.After(c.now):
+			t.stopped = true
+			due = append(due, t)
+		default:
+			pending = append(pending, t)
+		}
+	}
+	c.timers = pending
+	c.mu.Unlock()
+	// The callbacks may use the clock themselves.
+	for _, t := range due {
+		t.f()
+	}
+}
+
+type debounceTest struct {
+	t       *testing.T
+	clock   *fakeClock
+	d       *Debouncer
+	emitted []*Announcement
+}
+
+func newDebounceTest(t *testing.T) *debounceTest {
+	dt := &debounceTest{t: t, clock: newFakeClock()}
+	dt.d = NewDebouncer(dt.clock, func(a *Announcement) {
+		dt.emitted = append(dt.emitted, a)
+	})
+	return dt
+}
+
+func (dt *debounceTest) offer(e AnnounceEvent, userID string, flapWindow, cooldown time.Duration) *Announcement {
+	a := &Announcement{Event: e, UserID: userID}
+	dt.d.Offer(a, flapWindow, cooldown)
+	return a
+}
+
+// Checks that exactly the announcements were emitted since the last check.
+func (dt *debounceTest) expect(want ...*Announcement) {
+	dt.t.Helper()
+	if len(dt.emitted) != len(want) {
+		dt.t.Fatalf("emitted %d announcements, want %d", len(dt.emitted), len(want))
+	}
+	for i := range want {
+		if dt.emitted[i] != want[i] {
+			dt.t.Fatalf("announcement %d is %v of %s, want %v of %s", i,
+				dt.emitted[i].Event, dt.emitted[i].UserID, want[i].Event, want[i].UserID)
+		}
+	}
+	dt.emitted = nil
+}
+
+func TestDebouncerSuppressesFlaps(t *testing.T) {
+	dt := newDebounceTest(t)
+	const window = 5 * time.Second
+
+	dt.offer(announceLeave, "a", window, 0)
+	dt.clock.Advance(2 * time.Second)
+	dt.offer(announceJoin, "a", window, 0)
+	dt.expect()
+	// The held leave must not come through once its window has passed.
+	dt.clock.Advance(10 * time.Second)
+	dt.expect()
+
+	// Only the user that left is affected.
+	dt.offer(announceLeave, "a", window, 0)
+	join := dt.offer(announceJoin, "b", window, 0)
+	dt.expect(join)
+}
+
+func TestDebouncerReleasesHeldLeaves(t *testing.T) {
+	dt := newDebounceTest(t)
+	const window = 5 * time.Second
+
+	leave := dt.offer(announceLeave, "a", window, 0)
+	dt.clock.Advance(window - time.Millisecond)
+	dt.expect()
+	dt.clock.Advance(time.Millisecond)
+	dt.expect(leave)
+
+	// A join after the window is a new announcement.
+	join := dt.offer(announceJoin, "a", window, 0)
+	dt.expect(join)
+
+	// A flap window of 0 doesn't hold leaves back.
+	leave = dt.offer(announceLeave, "b", 0, 0)
+	dt.expect(leave)
+}
+
+func TestDebouncerCooldown(t *testing.T) {
+	dt := newDebounceTest(t)
+	const cooldown = 30 * time.Second
+
+	join := dt.offer(announceJoin, "a", 0, cooldown)
+	dt.expect(join)
+	dt.clock.Advance(10 * time.Second)
+	dt.offer(announceMove, "a", 0, cooldown)
+	dt.expect()
+	// Suppressed events don't extend the cooldown.
+	dt.clock.Advance(20 * time.Second)
+	move := dt.offer(announceMove, "a", 0, cooldown)
+	dt.expect(move)
+
+	// Other users have their own cooldown.
+	join = dt.offer(announceJoin, "b", 0, cooldown)
+	dt.expect(join)
+}
+
+func TestDebouncerFlapDoesNotCountTowardsCooldown(t *testing.T) {
+	dt := newDebounceTest(t)
+	const window = 5 * time.Second
+	const cooldown = 30 * time.Second
+
+	join := dt.offer(announceJoin, "a", window, cooldown)
+	dt.expect(join)
+	dt.clock.Advance(cooldown)
+	dt.offer(announceLeave, "a", window, cooldown)
+	dt.clock.Advance(time.Second)
+	dt.offer(announceJoin, "a", window, cooldown)
+	dt.expect()
+
+	// The cooldown still counts from the first join, so a leave right
+	// after the flap is held back and announced as usual.
+	leave := dt.offer(announceLeave, "a", window, cooldown)
+	dt.clock.Advance(window)
+	dt.expect(leave)
+}
@@ -5,8 +5,11 @@ go 1.21
 require (
 	cloud.google.com/go/texttospeech v1.7.6
 	github.com/goproslowyo/discordgo v0.28.2-0.20240318011839-ef55a1968998
+	go.etcd.io/bbolt v1.3.10
 	go.uber.org/zap v1.27.0
+	golang.org/x/text v0.14.0
 	google.golang.org/api v0.170.0
+	google.golang.org/grpc v1.62.1
 	layeh.com/gopus v0.0.0-20210501142526-1ee02d434e32
 )
 
@@ -36,11 +39,9 @@ require (
 	golang.org/x/oauth2 v0.18.0 // indirect
 	golang.org/x/sync v0.6.0 // indirect
 	golang.org/x/sys v0.18.0 // indirect
-	golang.org/x/text v0.14.0 // indirect
 	golang.org/x/time v0.5.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
 	google.golang.org/genproto/googleapis/api v0.0.0-20240314234333-6e1732d8331c // indirect
 	google.golang.org/genproto/googleapis/rpc v0.0.0-20240314234333-6e1732d8331c // indirect
-	google.golang.org/grpc v1.62.1 // indirect
 	google.golang.org/protobuf v1.33.0 // indirect
 )
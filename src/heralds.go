@@ -0,0 +1,446 @@
+// The herald sounds played before announcing someone who arrived. Sounds are
+// organized in sets: the files directly in announcement_path form the
+// "default" set, and every subdirectory is a set named after it. Guilds and
+// users choose from these sets with weighted pools that may be limited to
+// times of day or dates.
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const defaultHeraldSet = "default"
+
+// How often the announcement directory is checked for changes, at most.
+const heraldCheckInterval = 10 * time.Second
+
+// File types that can be used as heralds. ffmpeg plays anything, but other
+// files like READMEs should be left alone.
+var heraldExtensions = map[string]bool{
+	".opus": true,
+	".ogg":  true,
+	".mp3":  true,
+	".wav":  true,
+	".flac": true,
+	".m4a":  true,
+}
+
+// HeraldPool is a set of herald sounds a guild or user chooses from.
+type HeraldPool struct {
+	// The name of a set, i.e. a directory in announcement_path, or "default".
+	Set string `json:"set"`
+	// The chance of picking this pool relative to the other pools in use; 0
+	// counts as 1.
+	Weight float64 `json:"weight"`
+	// The chances of single sounds of the set relative to each other, by file
+	// name. Sounds that aren't listed count as 1, 0 disables a sound.
+	SoundWeights map[string]float64 `json:"sound_weights,omitempty"`
+	// If not empty, the pool is only used at these times of day: "morning",
+	// "afternoon", "evening" or "night", as in the templates.
+	TimesOfDay []string `json:"times_of_day,omitempty"`
+	// If not empty, the pool is only used on these dates, given as "MM-DD"
+	// or ranges like "12-24..12-26". Ranges may wrap around the new year.
+	Dates []string `json:"dates,omitempty"`
+}
+
+type HeraldSettings struct {
+	// The guild's pools. If empty, the default set is used.
+	Pools []HeraldPool `json:"pools"`
+	// User ID to the pools used when the user arrives alone.
+	Users map[string][]HeraldPool `json:"users"`
+	// The number of most recently played heralds that aren't played again,
+	// as long as there are others to choose from.
+	NoRepeat int `json:"no_repeat"`
+}
+
+// Pools limited to dates take precedence over pools limited to times of day,
+// which take precedence over unlimited pools.
+func (p *HeraldPool) specificity() int {
+	switch {
+	case len(p.Dates) > 0:
+		return 2
+	case len(p.TimesOfDay) > 0:
+		return 1
+	}
+	return 0
+}
+
+// Reports whether the pool may be used at t. Invalid dates never match.
+func (p *HeraldPool) activeAt(t time.Time) bool {
+	if len(p.TimesOfDay) > 0 {
+		var data AnnounceData
+		data.setTime(t)
+		found := false
+		for _, tod := range p.TimesOfDay {
+			if strings.EqualFold(tod, data.TimeOfDay) {
+				found = true
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(p.Dates) == 0 {
+		return true
+	}
+	today := t.Format("01-02")
+	for _, d := range p.Dates {
+		from, to, isRange := strings.Cut(d, "..")
+		if !isRange {
+			to = from
+		}
+		if !validHeraldDate(from) || !validHeraldDate(to) {
+			logger.Sugar().Warnf("Invalid herald date '%s', expected MM-DD or MM-DD..MM-DD.", d)
+			continue
+		}
+		// MM-DD strings compare like dates.
+		if from <= to && today >= from && today <= to {
+			return true
+		}
+		if from > to && (today >= from || today <= to) {
+			return true
+		}
+	}
+	return false
+}
+
+func validHeraldDate(d string) bool {
+	_, err := time.Parse("01-02", d)
+	return err == nil
+}
+
+func (p *HeraldPool) weight() float64 {
+	if p.Weight <= 0 {
+		return 1
+	}
+	return p.Weight
+}
+
+// //////////////////////////////
+// The library of sounds.
+// //////////////////////////////
+
+// HeraldLibrary holds the herald sets found in the announcement directory. It
+// is loaded once and reloaded when a directory changes.
+type HeraldLibrary struct {
+	sync.Mutex
+	dir       string
+	sets      map[string][]string // Set name to file paths.
+	modTimes  map[string]time.Time
+	lastCheck time.Time
+	// Guild ID to the most recently played heralds, newest last.
+	recent map[string][]string
+	// File paths to their loudness normalized copies.
+	normalized map[string]string
+	// Held while creating normalized copies.
+	mNormalize sync.Mutex
+}
+
+func NewHeraldLibrary(dir string) *HeraldLibrary {
+	l := &HeraldLibrary{
+		dir:        dir,
+		recent:     make(map[string][]string),
+		normalized: make(map[string]string),
+	}
+	l.load()
+	return l
+}
+
+// Reads the sets from the directory. The lock must be held.
+func (l *HeraldLibrary) load() {
+	l.sets = make(map[string][]string)
+	l.modTimes = make(map[string]time.Time)
+	l.lastCheck = time.Now()
+
+	dirs := map[string]string{defaultHeraldSet: l.dir}
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		logger.Warn("Can't read the herald sounds, arrivals are announced without them",
+			zap.String("dir", l.dir), zap.Error(err))
+		return
+	}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if e.Name() == defaultHeraldSet {
+			// It would replace the sounds trumpet ships with.
+			logger.Sugar().Warnf("Ignoring the herald directory %s: the name '%s' is reserved for the files directly in %s, please rename it.",
+				filepath.Join(l.dir, e.Name()), defaultHeraldSet, l.dir)
+			continue
+		}
+		dirs[e.Name()] = filepath.Join(l.dir, e.Name())
+	}
+
+	total := 0
+	for name, dir := range dirs {
+		if info, err := os.Stat(dir); err == nil {
+			l.modTimes[dir] = info.ModTime()
+		}
+		files, err := os.ReadDir(dir)
+		if err != nil {
+			logger.Warn("Can't read herald set", zap.String("dir", dir), zap.Error(err))
+			continue
+		}
+		for _, f := range files {
+			if !f.IsDir() && heraldExtensions[strings.ToLower(filepath.Ext(f.Name()))] {
+				l.sets[name] = append(l.sets[name], filepath.Join(dir, f.Name()))
+			}
+		}
+		total += len(l.sets[name])
+	}
+	logger.Sugar().Infof("Loaded %d herald sounds in %d sets.", total, len(l.sets))
+
+	if _, ok := cfg().loudnorm(); ok {
+		var files []string
+		for _, set := range l.sets {
+			files = append(files, set...)
+		}
+		go l.normalize(files)
+	}
+}
+
+// The normalized copies of the heralds are kept next to the fallback clips,
+// where the clip cache leaves them alone.
+func heraldCacheDir() string {
+	return filepath.Join(cfg().UserAudioPath, "heralds")
+}
+
+// Creates loudness normalized copies of the files that don't have one yet and
+// deletes the copies of files that are gone. Until its copy exists, a herald
+// is played as it is.
+func (l *HeraldLibrary) normalize(files []string) {
+	l.mNormalize.Lock()
+	defer l.mNormalize.Unlock()
+	dir := heraldCacheDir()
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		logger.Error("Failed to create the herald cache directory", zap.Error(err))
+		return
+	}
+	opts, _ := cfg().loudnorm()
+	wanted := make(map[string]bool)
+	for _, f := range files {
+		info, err := os.Stat(f)
+		if err != nil {
+			continue
+		}
+		// Changing a file or the target results in a new copy.
+		sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%g", f, info.Size(), info.ModTime().UnixNano(), opts.Target)))
+		name := fmt.Sprintf("%x.ogg", sum[:16])
+		path := filepath.Join(dir, name)
+		wanted[name] = true
+		if _, err := os.Stat(path); err != nil {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+			data, err := normalizeFile(ctx, f)
+			cancel()
+			if err == nil {
+				if err = os.WriteFile(path+".tmp", data, 0640); err == nil {
+					err = os.Rename(path+".tmp", path)
+				}
+			}
+			if err != nil {
+				logger.Warn("Failed to normalize herald", zap.String("file", f), zap.Error(err))
+				continue
+			}
+		}
+		l.Lock()
+		l.normalized[f] = path
+		l.Unlock()
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		if !wanted[e.Name()] {
+			os.Remove(filepath.Join(dir, e.Name()))
+		}
+	}
+}
+
+// Reloads the sets if a directory changed since they were loaded, checking at
+// most every heraldCheckInterval. The lock must be held.
+func (l *HeraldLibrary) refresh() {
+	if time.Since(l.lastCheck) < heraldCheckInterval {
+		return
+	}
+	l.lastCheck = time.Now()
+	// The directory may have been created since.
+	_, err := os.Stat(l.dir)
+	changed := err == nil && len(l.modTimes) == 0
+	for dir, modTime := range l.modTimes {
+		if info, err := os.Stat(dir); err != nil || !info.ModTime().Equal(modTime) {
+			changed = true
+		}
+	}
+	if changed {
+		l.load()
+	}
+}
+
+// Returns the names of the sets and their number of sounds.
+func (l *HeraldLibrary) Sets() map[string]int {
+	l.Lock()
+	defer l.Unlock()
+	l.refresh()
+	sets := make(map[string]int, len(l.sets))
+	for name, files := range l.sets {
+		sets[name] = len(files)
+	}
+	return sets
+}
+
+type heraldCandidate struct {
+	path   string
+	weight float64
+}
+
+// Returns the candidates of the active pools with the highest specificity, or
+// nil if none of them has any sounds. The lock must be held.
+func (l *HeraldLibrary) candidates(pools []HeraldPool, t time.Time) []heraldCandidate {
+	best := -1
+	var active []*HeraldPool
+	for i := range pools {
+		p := &pools[i]
+		if len(l.sets[p.Set]) == 0 {
+			logger.Sugar().Debugf("Herald set '%s' doesn't exist or has no sounds.", p.Set)
+			continue
+		}
+		if !p.activeAt(t) {
+			continue
+		}
+		switch s := p.specificity(); {
+		case s > best:
+			best = s
+			active = []*HeraldPool{p}
+		case s == best:
+			active = append(active, p)
+		}
+	}
+
+	var candidates []heraldCandidate
+	for _, p := range active {
+		files := l.sets[p.Set]
+		var sum float64
+		weights := make([]float64, len(files))
+		for i, f := range files {
+			weights[i] = 1
+			if w, ok := p.SoundWeights[filepath.Base(f)]; ok {
+				weights[i] = w
+			}
+			sum += weights[i]
+		}
+		if sum <= 0 {
+			continue
+		}
+		// The weight of the pool is split among its sounds.
+		for i, f := range files {
+			if weights[i] > 0 {
+				candidates = append(candidates, heraldCandidate{path: f, weight: p.weight() * weights[i] / sum})
+			}
+		}
+	}
+	return candidates
+}
+
+// Picks the herald to play in the guild when userID arrives, or when several
+// users arrive if userID is empty. It returns false if there is no herald to
+// play.
+func (l *HeraldLibrary) Pick(gs *GuildSettings, guildID, userID string, t time.Time) (string, bool) {
+	l.Lock()
+	defer l.Unlock()
+	l.refresh()
+
+	var candidates []heraldCandidate
+	if userID != "" {
+		candidates = l.candidates(gs.Heralds.Users[userID], t)
+	}
+	if len(candidates) == 0 {
+		candidates = l.candidates(gs.Heralds.Pools, t)
+	}
+	if len(candidates) == 0 {
+		candidates = l.candidates([]HeraldPool{{Set: defaultHeraldSet}}, t)
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	recent := l.recent[guildID]
+	fresh := candidates[:0:0]
+	for _, c := range candidates {
+		played := false
+		for _, r := range recent {
+			played = played || r == c.path
+		}
+		if !played {
+			fresh = append(fresh, c)
+		}
+	}
+	if len(fresh) > 0 {
+		candidates = fresh
+	}
+
+	var sum float64
+	for _, c := range candidates {
+		sum += c.weight
+	}
+	pick := candidates[len(candidates)-1].path
+	r := rand.Float64() * sum
+	for _, c := range candidates {
+		if r < c.weight {
+			pick = c.path
+			break
+		}
+		r -= c.weight
+	}
+
+	if gs.Heralds.NoRepeat > 0 {
+		recent = append(recent, pick)
+		if len(recent) > gs.Heralds.NoRepeat {
+			recent = recent[len(recent)-gs.Heralds.NoRepeat:]
+		}
+		l.recent[guildID] = recent
+	} else {
+		delete(l.recent, guildID)
+	}
+	logger.Debug("Chose herald", zap.String("guild", guildID), zap.String("file", pick))
+	if normalized, ok := l.normalized[pick]; ok {
+		return normalized, true
+	}
+	return pick, true
+}
+
+// //////////////////////////////
+// The actual command.
+// //////////////////////////////
+func commandHeralds(ctx *CommandContext) {
+	sets := heralds.Sets()
+	if len(sets) == 0 {
+		ctx.Messagef("There are no herald sounds.")
+		return
+	}
+	names := make([]string, 0, len(sets))
+	for name := range sets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	b.WriteString("Herald sets:\n")
+	for _, name := range names {
+		fmt.Fprintf(&b, "- `%s`: %d sounds\n", name, sets[name])
+	}
+	b.WriteString("Admins can choose sets with `settings set heralds <JSON>`.")
+	ctx.Messagef("%s", b.String())
+}
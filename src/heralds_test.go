@@ -0,0 +1,242 @@
+package main
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Returns a library with the given sets that doesn't look at the disk.
+func testHeraldLibrary(sets map[string][]string) *HeraldLibrary {
+	return &HeraldLibrary{
+		sets:       sets,
+		recent:     make(map[string][]string),
+		normalized: make(map[string]string),
+		lastCheck:  time.Now().Add(time.Hour),
+	}
+}
+
+func TestHeraldPoolActiveAt(t *testing.T) {
+	tests := []struct {
+		pool HeraldPool
+		at   string
+		want bool
+	}{
+		{HeraldPool{}, "2024-06-01 03:00", true},
+		{HeraldPool{TimesOfDay: []string{"morning"}}, "2024-06-01 08:00", true},
+		{HeraldPool{TimesOfDay: []string{"Morning"}}, "2024-06-01 08:00", true},
+		{HeraldPool{TimesOfDay: []string{"morning"}}, "2024-06-01 12:00", false},
+		{HeraldPool{TimesOfDay: []string{"evening", "night"}}, "2024-06-01 23:30", true},
+		{HeraldPool{Dates: []string{"06-01"}}, "2024-06-01 12:00", true},
+		{HeraldPool{Dates: []string{"06-01"}}, "2024-06-02 12:00", false},
+		{HeraldPool{Dates: []string{"12-24..12-26"}}, "2024-12-25 12:00", true},
+		{HeraldPool{Dates: []string{"12-24..12-26"}}, "2024-12-27 12:00", false},
+		// Ranges wrap around the new year.
+		{HeraldPool{Dates: []string{"12-31..01-02"}}, "2024-12-31 12:00", true},
+		{HeraldPool{Dates: []string{"12-31..01-02"}}, "2025-01-02 12:00", true},
+		{HeraldPool{Dates: []string{"12-31..01-02"}}, "2025-01-03 12:00", false},
+		{HeraldPool{Dates: []string{"13-01", "6-1", "06-01..x"}}, "2024-06-01 12:00", false},
+		{HeraldPool{Dates: []string{"bad", "06-01"}}, "2024-06-01 12:00", true},
+		// Both limits have to match.
+		{HeraldPool{Dates: []string{"10-31"}, TimesOfDay: []string{"night"}}, "2024-10-31 23:00", true},
+		{HeraldPool{Dates: []string{"10-31"}, TimesOfDay: []string{"night"}}, "2024-10-31 12:00", false},
+	}
+	for _, tt := range tests {
+		at, err := time.Parse("2006-01-02 15:04", tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tt.pool.activeAt(at); got != tt.want {
+			t.Errorf("%+v active at %s: %t, want %t", tt.pool, tt.at, got, tt.want)
+		}
+	}
+}
+
+func TestHeraldCandidates(t *testing.T) {
+	l := testHeraldLibrary(map[string][]string{
+		"default":  {"/a/default.opus"},
+		"fanfare":  {"/a/fanfare/one.opus", "/a/fanfare/two.opus", "/a/fanfare/three.opus"},
+		"spooky":   {"/a/spooky/boo.opus"},
+		"birthday": {"/a/birthday/cake.opus"},
+		"mornings": {"/a/mornings/rooster.opus"},
+		"emptyish": {"/a/emptyish/off.opus"},
+	})
+	weights := func(c []heraldCandidate) map[string]float64 {
+		m := make(map[string]float64)
+		for _, h := range c {
+			m[filepath.Base(h.path)] = h.weight
+		}
+		return m
+	}
+	noon := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	morning := time.Date(2024, 6, 1, 8, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name  string
+		pools []HeraldPool
+		at    time.Time
+		want  map[string]float64
+	}{
+		{
+			"the weight of a pool is split among its sounds",
+			[]HeraldPool{
+				{Set: "fanfare", Weight: 3, SoundWeights: map[string]float64{"one.opus": 2, "three.opus": 0}},
+				{Set: "spooky"},
+			},
+			noon,
+			map[string]float64{"one.opus": 2, "two.opus": 1, "boo.opus": 1},
+		},
+		{
+			"missing sets and pools without enabled sounds are left out",
+			[]HeraldPool{
+				{Set: "missing"},
+				{Set: "emptyish", SoundWeights: map[string]float64{"off.opus": 0}},
+				{Set: "spooky", Weight: 2},
+			},
+			noon,
+			map[string]float64{"boo.opus": 2},
+		},
+		{
+			"times of day replace unlimited pools",
+			[]HeraldPool{{Set: "spooky"}, {Set: "mornings", TimesOfDay: []string{"morning"}}},
+			morning,
+			map[string]float64{"rooster.opus": 1},
+		},
+		{
+			"inactive pools don't count",
+			[]HeraldPool{{Set: "spooky"}, {Set: "mornings", TimesOfDay: []string{"morning"}}},
+			noon,
+			map[string]float64{"boo.opus": 1},
+		},
+		{
+			"dates replace times of day",
+			[]HeraldPool{
+				{Set: "mornings", TimesOfDay: []string{"morning"}},
+				{Set: "birthday", Dates: []string{"06-01"}},
+			},
+			morning,
+			map[string]float64{"cake.opus": 1},
+		},
+		{"no pools", nil, noon, map[string]float64{}},
+	}
+	for _, tt := range tests {
+		got := weights(l.candidates(tt.pools, tt.at))
+		if len(got) != len(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+			continue
+		}
+		for f, w := range tt.want {
+			if math.Abs(got[f]-w) > 1e-9 {
+				t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestHeraldPickFallsBack(t *testing.T) {
+	l := testHeraldLibrary(map[string][]string{
+		"default": {"/a/default.opus"},
+		"spooky":  {"/a/spooky/boo.opus"},
+		"mine":    {"/a/mine/me.opus"},
+	})
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	gs := defaultGuildSettings()
+	gs.Heralds.NoRepeat = 0
+
+	pick := func(userID string) string {
+		t.Helper()
+		p, ok := l.Pick(&gs, "1", userID, at)
+		if !ok {
+			t.Fatal("no herald was picked")
+		}
+		return p
+	}
+	if p := pick("2"); p != "/a/default.opus" {
+		t.Errorf("picked %s without pools, want the default set", p)
+	}
+	gs.Heralds.Pools = []HeraldPool{{Set: "spooky"}}
+	if p := pick("2"); p != "/a/spooky/boo.opus" {
+		t.Errorf("picked %s, want the guild's pool", p)
+	}
+	gs.Heralds.Users = map[string][]HeraldPool{"2": {{Set: "mine"}}, "3": {{Set: "missing"}}}
+	if p := pick("2"); p != "/a/mine/me.opus" {
+		t.Errorf("picked %s, want the user's pool", p)
+	}
+	if p := pick("3"); p != "/a/spooky/boo.opus" {
+		t.Errorf("picked %s for a user with an empty pool, want the guild's pool", p)
+	}
+	// Several users arriving at once get the guild's heralds.
+	if p := pick(""); p != "/a/spooky/boo.opus" {
+		t.Errorf("picked %s for a group, want the guild's pool", p)
+	}
+
+	if _, ok := testHeraldLibrary(map[string][]string{}).Pick(&gs, "1", "2", at); ok {
+		t.Error("picked a herald without any sounds")
+	}
+}
+
+func TestHeraldPickNoRepeat(t *testing.T) {
+	l := testHeraldLibrary(map[string][]string{
+		"default": {"/a/1.opus", "/a/2.opus", "/a/3.opus"},
+	})
+	at := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	gs := defaultGuildSettings()
+	gs.Heralds.NoRepeat = 2
+
+	// With 3 sounds and the last 2 excluded, each herald differs from the
+	// 2 before it.
+	var picks []string
+	for i := 0; i < 30; i++ {
+		p, ok := l.Pick(&gs, "1", "", at)
+		if !ok {
+			t.Fatal("no herald was picked")
+		}
+		for _, prev := range picks[max(0, len(picks)-2):] {
+			if p == prev {
+				t.Fatalf("pick %d repeated %s: %v", i, p, picks)
+			}
+		}
+		picks = append(picks, p)
+	}
+	if len(l.recent["1"]) != 2 {
+		t.Errorf("remembered %d heralds, want 2", len(l.recent["1"]))
+	}
+	// Other guilds have their own history.
+	if len(l.recent["2"]) != 0 {
+		t.Errorf("guild 2 has a history: %v", l.recent["2"])
+	}
+
+	// If every sound was played recently, one of them is played anyway.
+	gs.Heralds.NoRepeat = 5
+	for i := 0; i < 5; i++ {
+		if _, ok := l.Pick(&gs, "1", "", at); !ok {
+			t.Fatal("no herald was picked although all were played recently")
+		}
+	}
+
+	gs.Heralds.NoRepeat = 0
+	l.Pick(&gs, "1", "", at)
+	if _, ok := l.recent["1"]; ok {
+		t.Error("the history was kept with no_repeat 0")
+	}
+}
+
+func TestHeraldLibraryReservesDefault(t *testing.T) {
+	dir := t.TempDir()
+	for _, f := range []string{"shipped.opus", "README.md", "default/mine.opus", "christmas/bells.ogg"} {
+		path := filepath.Join(dir, f)
+		if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, nil, 0640); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sets := NewHeraldLibrary(dir).Sets()
+	if len(sets) != 2 || sets[defaultHeraldSet] != 1 || sets["christmas"] != 1 {
+		t.Errorf("loaded sets %v, want the shipped default set and christmas", sets)
+	}
+}
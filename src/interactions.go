@@ -0,0 +1,109 @@
+// Slash command (application command) support. Slash commands are translated
+// into the same arguments as prefix commands and run through runCommand.
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+// Registers the slash commands globally, replacing any stale ones.
+func registerSlashCommands(s *discordgo.Session) {
+	defs := slashCommandDefinitions()
+	_, err := s.ApplicationCommandBulkOverwrite(s.State.User.ID, "", defs)
+	if err != nil {
+		logger.Sugar().Errorf("Error registering slash commands: %s", err)
+		return
+	}
+	logger.Sugar().Infof("Registered %d slash commands.", len(defs))
+}
+
+// Converts the options of a slash command into prefix command arguments, in
+// the order in which the command declares them. Discord sends them in the
+// order the user typed them.
+func slashCommandArgs(data discordgo.ApplicationCommandInteractionData) []string {
+	cmd, ok := LookupCommand(data.Name)
+	if !ok {
+		return nil
+	}
+	return commandArgs(cmd, data.Options)
+}
+
+func commandArgs(cmd *Command, options []*discordgo.ApplicationCommandInteractionDataOption) []string {
+	values := make(map[string]string)
+	for _, opt := range options {
+		switch opt.Type {
+		case discordgo.ApplicationCommandOptionString:
+			values[opt.Name] = opt.StringValue()
+		case discordgo.ApplicationCommandOptionInteger:
+			values[opt.Name] = strconv.FormatInt(opt.IntValue(), 10)
+		case discordgo.ApplicationCommandOptionUser:
+			values[opt.Name] = "<@" + opt.UserValue(nil).ID + ">"
+		case discordgo.ApplicationCommandOptionRole:
+			values[opt.Name] = "<@&" + opt.RoleValue(nil, "").ID + ">"
+		}
+	}
+	var args []string
+	for i, opt := range cmd.Options {
+		value := values[opt.Name]
+		if cmd.TextOption && i == len(cmd.Options)-1 {
+			if strings.TrimSpace(value) != "" {
+				args = append(args, value)
+			}
+			continue
+		}
+		args = append(args, strings.Fields(value)...)
+	}
+	return args
+}
+
+// Returns the files passed as attachment options.
+func slashCommandAttachments(data discordgo.ApplicationCommandInteractionData) []*discordgo.MessageAttachment {
+	var attachments []*discordgo.MessageAttachment
+	for _, opt := range data.Options {
+		if opt.Type != discordgo.ApplicationCommandOptionAttachment || data.Resolved == nil {
+			continue
+		}
+		id, _ := opt.Value.(string)
+		if a, ok := data.Resolved.Attachments[id]; ok {
+			attachments = append(attachments, a)
+		}
+	}
+	return attachments
+}
+
+func interactionCreate(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	g, err := s.State.Guild(i.GuildID)
+	if err != nil || i.Member == nil {
+		s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "This bot only works in guilds (servers).",
+			},
+		})
+		return
+	}
+
+	// Commands may take longer than the 3 seconds Discord gives us to
+	// respond, so we defer the response and let the first message the
+	// command sends answer it.
+	err = s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		logger.Sugar().Errorf("Error responding to interaction: %s", err)
+		return
+	}
+
+	c := GetClient(s, i.GuildID)
+	c.UpdateChannels(g, i.ChannelID, i.Member.User.ID)
+
+	data := i.ApplicationCommandData()
+	runCommand(s, g, c, i.Member.User, i.Member, i.ChannelID, data.Name, slashCommandArgs(data), slashCommandAttachments(data), i.Interaction)
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+func TestCommandArgs(t *testing.T) {
+	str := func(name, value string) *discordgo.ApplicationCommandInteractionDataOption {
+		return &discordgo.ApplicationCommandInteractionDataOption{
+			Name: name, Type: discordgo.ApplicationCommandOptionString, Value: value,
+		}
+	}
+	user := &discordgo.ApplicationCommandInteractionDataOption{
+		Name: "user", Type: discordgo.ApplicationCommandOptionUser, Value: "42",
+	}
+	volume := &discordgo.ApplicationCommandInteractionDataOption{
+		Name: "volume", Type: discordgo.ApplicationCommandOptionInteger, Value: float64(80),
+	}
+	role := &discordgo.ApplicationCommandInteractionDataOption{
+		Name: "role", Type: discordgo.ApplicationCommandOptionRole, Value: "7",
+	}
+
+	tests := []struct {
+		command string
+		options []*discordgo.ApplicationCommandInteractionDataOption
+		want    []string
+	}{
+		// Options are passed in the declared order, not the typed one.
+		{"setname", []*discordgo.ApplicationCommandInteractionDataOption{user, str("name", "Alice  Smith")},
+			[]string{"Alice", "Smith", "<@42>"}},
+		{"volume", []*discordgo.ApplicationCommandInteractionDataOption{volume, str("target", "announce")},
+			[]string{"announce", "80"}},
+		{"ignore", []*discordgo.ApplicationCommandInteractionDataOption{role}, []string{"<@&7>"}},
+		{"announceopts", []*discordgo.ApplicationCommandInteractionDataOption{user, str("options", "lang=de  rate=1.5")},
+			[]string{"lang=de", "rate=1.5", "<@42>"}},
+		{"delete", []*discordgo.ApplicationCommandInteractionDataOption{str("ids", "1 3-5")}, []string{"1", "3-5"}},
+		// Free text is passed as typed.
+		{"settings", []*discordgo.ApplicationCommandInteractionDataOption{
+			str("value", `{"alice": "Alice  B."}`), str("key", "custom_names"), str("action", "set"),
+		}, []string{"set", "custom_names", `{"alice": "Alice  B."}`}},
+		{"settings", []*discordgo.ApplicationCommandInteractionDataOption{str("action", "get"), str("key", "prefix")},
+			[]string{"get", "prefix"}},
+		{"preview", []*discordgo.ApplicationCommandInteractionDataOption{str("text", `<sub alias="A  B">AB</sub>`)},
+			[]string{`<sub alias="A  B">AB</sub>`}},
+		{"preview", []*discordgo.ApplicationCommandInteractionDataOption{str("text", "  ")}, nil},
+		{"help", nil, nil},
+	}
+	for _, tt := range tests {
+		cmd, ok := LookupCommand(tt.command)
+		if !ok {
+			t.Fatalf("no command %s", tt.command)
+		}
+		got := commandArgs(cmd, tt.options)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Loudness normalization. TTS clips, custom sounds and heralds are normalized
+// once when they are created, music while it plays: with the values measured
+// while it was downloaded completely the last time it was played, dynamically
+// otherwise.
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/goproslowyo/trumpet/dca0"
+
+	"go.uber.org/zap"
+)
+
+// Normalizes the audio file and returns it encoded as Ogg/Opus.
+func normalizeFile(ctx context.Context, path string) ([]byte, error) {
+	opts, _ := cfg().loudnorm()
+	m, err := dca0.MeasureLoudness(ctx, cfg().FfmpegPath, path, opts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure loudness: %w", err)
+	}
+	opts.Measured = m
+	cmd := exec.CommandContext(ctx, cfg().FfmpegPath,
+		"-hide_banner",
+		"-i", path,
+		"-vn",
+		"-af", dca0.LoudnormFilter(opts),
+		// loudnorm resamples to 192kHz.
+		"-ar", "48000",
+		"-c:a", "libopus",
+		"-b:a", "96k",
+		"-f", "ogg",
+		"pipe:1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Normalizes audio of any format ffmpeg understands and returns it encoded as
+// Ogg/Opus.
+func normalizeAudio(ctx context.Context, audio []byte) ([]byte, error) {
+	// Normalizing reads the input twice.
+	f, err := os.CreateTemp("", "trumpet-loudnorm-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(audio)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	return normalizeFile(ctx, f.Name())
+}
+
+// normalizingTTS normalizes the clips of a TTS provider.
+type normalizingTTS struct {
+	TTSProvider
+}
+
+func (n normalizingTTS) Synthesize(ctx context.Context, text string, voice VoiceProfile) ([]byte, error) {
+	clip, err := n.TTSProvider.Synthesize(ctx, text, voice)
+	if err != nil {
+		return nil, err
+	}
+	normalized, err := normalizeAudio(ctx, clip)
+	if err != nil {
+		// An unnormalized clip is better than none.
+		logger.Warn("Failed to normalize clip", zap.String("text", text), zap.Error(err))
+		return clip, nil
+	}
+	return normalized, nil
+}
+
+// //////////////////////////////
+// Music.
+// //////////////////////////////
+
+func loudnessKey(opts dca0.LoudnormOptions, t Track) string {
+	media := t.Url
+	if media == "" {
+		media = t.MediaUrl
+	}
+	return fmt.Sprintf("%g|%s", opts.Target, media)
+}
+
+// Returns the options normalizing the track, or nil if normalization is
+// disabled. Tracks that weren't measured yet are normalized dynamically and
+// measured while they play (see saveMusicLoudness), so that they are
+// normalized linearly the next time.
+func musicLoudnorm(t Track) *dca0.LoudnormOptions {
+	opts, ok := cfg().loudnorm()
+	if !ok {
+		return nil
+	}
+	if m, ok := store.Loudness(loudnessKey(opts, t)); ok {
+		opts.Measured = m
+	}
+	return &opts
+}
+
+// Returns the function saving the loudness of the track measured during
+// playback, or nil if it doesn't need to be measured.
+func saveMusicLoudness(t Track, opts *dca0.LoudnormOptions) func(*dca0.LoudnessMeasurement) {
+	if opts == nil || opts.Measured != nil {
+		return nil
+	}
+	key := loudnessKey(*opts, t)
+	return func(m *dca0.LoudnessMeasurement) {
+		if err := store.SetLoudness(key, m); err != nil {
+			logger.Error("Failed to save loudness", zap.String("track", t.Url), zap.Error(err))
+		}
+	}
+}
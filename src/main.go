@@ -2,13 +2,9 @@ package main
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"os"
 	"os/signal"
-	"path/filepath"
-	"strconv"
-	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -16,13 +12,9 @@ import (
 	"github.com/goproslowyo/trumpet/dca0"
 	"github.com/goproslowyo/trumpet/util"
 
-	texttospeech "cloud.google.com/go/texttospeech/apiv1"
 	"github.com/goproslowyo/discordgo"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
-	"google.golang.org/api/option"
-
-	texttospeechpb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
 )
 
 // //////////////////////////////
@@ -55,6 +47,7 @@ type Track struct {
 	Title    string // Title, if any.
 	Url      string // Short URL, for example from YouTube.
 	MediaUrl string // Long URL of the associated media file.
+	Live     bool   // Whether it is a live stream.
 }
 
 // All methods of Client are thread safe, however manual locking is required
@@ -64,6 +57,8 @@ type Client struct {
 
 	// The discordgo session.
 	s *discordgo.Session
+	// The guild this client belongs to.
+	GuildID string
 
 	// TextChannelID and VoiceChannelID indicate the current channels through
 	// which the bot should send text / audio. They may be set to "".
@@ -78,48 +73,29 @@ type Client struct {
 	LogClient *zap.Logger
 }
 
-func NewClient(s *discordgo.Session) *Client {
+func NewClient(s *discordgo.Session, guildID string) *Client {
 	return &Client{
 		s:         s,
+		GuildID:   guildID,
 		LogClient: logger,
 	}
 }
 
-func SynthesizeSpeech(googleServiceAccount string, text string) []byte {
-	b, err := os.ReadFile(googleServiceAccount)
-	if err != nil {
-		logger.Fatal(fmt.Sprintf("unable to open google service account file: %s\n", err.Error()))
-	}
-	ctx := context.Background()
-	c, err := texttospeech.NewClient(ctx, option.WithCredentialsJSON(b))
-	if err != nil {
-		logger.Sugar().Fatalf("Failed to create client: %s", err.Error())
-	}
-	defer c.Close()
-
-	si := &texttospeechpb.SynthesisInput{
-		InputSource: &texttospeechpb.SynthesisInput_Text{Text: text},
-	}
-	vsp := &texttospeechpb.VoiceSelectionParams{
-		LanguageCode: "en-US",
-		Name:         "en-US-Wavenet-F",
-	}
-	ac := &texttospeechpb.AudioConfig{
-		AudioEncoding: texttospeechpb.AudioEncoding_OGG_OPUS,
-		SpeakingRate:  1.5,
-	}
-	req := &texttospeechpb.SynthesizeSpeechRequest{
-		Input:       si,
-		Voice:       vsp,
-		AudioConfig: ac,
-	}
-
-	resp, err := c.SynthesizeSpeech(ctx, req)
-	if err != nil {
-		logger.Error(err.Error())
+// Returns the client of the guild, creating it if it doesn't exist yet.
+func GetClient(s *discordgo.Session, guildID string) *Client {
+	mClients.Lock()
+	defer mClients.Unlock()
+	c, ok := clients[guildID]
+	if !ok {
+		c = NewClient(s, guildID)
+		clients[guildID] = c
 	}
+	return c
+}
 
-	return resp.AudioContent
+// Returns the command prefix of the client's guild.
+func (c *Client) Prefix() string {
+	return GetGuildSettings(c.GuildID).Prefix
 }
 
 func (c *Client) DebugLog(format string, a interface{}) {
@@ -128,21 +104,22 @@ func (c *Client) DebugLog(format string, a interface{}) {
 
 func (c *Client) Messagef(format string, a ...interface{}) {
 	c.RLock()
-	if c.TextChannelID == "" {
+	textChannelID := c.TextChannelID
+	c.RUnlock()
+	if textChannelID == "" {
 		fmt.Printf(format+"\n", a...)
 	} else {
-		c.s.ChannelMessageSend(c.TextChannelID, fmt.Sprintf(format, a...))
+		c.s.ChannelMessageSend(textChannelID, fmt.Sprintf(format, a...))
 	}
-	c.RUnlock()
 }
 
 // Updates the text channel and voice channel IDs. May set them to "" if there
 // are none associated with the message.
-func (c *Client) UpdateChannels(g *discordgo.Guild, m *discordgo.Message) {
+func (c *Client) UpdateChannels(g *discordgo.Guild, channelID string, userID string) {
 	c.Lock()
-	c.TextChannelID = m.ChannelID
+	c.TextChannelID = channelID
 
-	vc, _ := GetUserVoiceChannel(g, m.Author.ID)
+	vc, _ := GetUserVoiceChannel(g, userID)
 	c.VoiceChannelID = vc
 	c.Unlock()
 }
@@ -253,67 +230,23 @@ func (c *Client) QueueClear() {
 	c.Unlock()
 }
 
-// GetAudioFile checks the audio cache or creates the file.
-func GetAudioFile(messages []string, userid string, username string) error {
-	for {
-		if strings.Contains(username, "../") {
-			username = strings.ReplaceAll(username, "../", "")
-			continue
-		}
-		if strings.Contains(username, "./") {
-			username = strings.ReplaceAll(username, "./", "")
-			continue
-		}
-
-		break
-	}
-
-	filename := fmt.Sprintf("%s_%s", userid, username)
-	joinPath := fmt.Sprintf("%s_join.ogg", filepath.Join(cfg.UserAudioPath, filename))
-	partPath := fmt.Sprintf("%s_leave.ogg", filepath.Join(cfg.UserAudioPath, filename))
-
-	jf, err := os.OpenFile(joinPath, os.O_RDONLY, 0640)
-	defer func() {
-		_ = jf.Close()
-	}()
-
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, os.ErrNotExist) {
-		return err
-	}
-
-	logger.Warn("Join file doesn't exist, creating...")
-	joinGreet := SynthesizeSpeech(cfg.GoogleServiceAccountCredentials, messages[0])
-	err = os.WriteFile(joinPath, joinGreet, 0640)
-	if err != nil {
-		logger.Error("Failed to write greeting file",
-			zap.Error(err),
-		)
-	}
-
-	pf, err := os.OpenFile(partPath, os.O_RDONLY, 0640)
-	defer func() {
-		_ = pf.Close()
-	}()
+// GetAudioFile returns the path of the clip speaking text in the given voice,
+// from the clip cache or newly synthesized.
+func GetAudioFile(ctx context.Context, text string, voice VoiceProfile) (string, error) {
+	return clipCache.Get(ctx, ttsProvider, ttsProviderName(), text, voice)
+}
 
-	if err == nil {
-		return nil
-	}
-	if !errors.Is(err, os.ErrNotExist) {
-		return err
+// Identifies the configured TTS provider in clip cache keys.
+func ttsProviderName() string {
+	provider := cfg().TTSProvider
+	if provider == ttsProviderPiper {
+		// The model decides what piper sounds like.
+		provider += ":" + cfg().PiperModel
 	}
-	logger.Warn("Leave file doesn't exist, creating...")
-	partGreet := SynthesizeSpeech(cfg.GoogleServiceAccountCredentials, messages[1])
-	err = os.WriteFile(partPath, partGreet, 0640)
-	if err != nil {
-		logger.Error("Failed to write file:",
-			zap.Error(err),
-		)
+	if opts, ok := cfg().loudnorm(); ok {
+		provider += fmt.Sprintf("|%gLUFS", opts.Target)
 	}
-
-	return nil
+	return provider
 }
 
 // //////////////////////////////
@@ -322,11 +255,24 @@ func GetAudioFile(messages []string, userid string, username string) error {
 var clients map[string]*Client // Guild ID to client
 var mClients sync.Mutex
 
-var mPlayAudio sync.Mutex
+var players map[string]*GuildPlayer // Guild ID to player
+var mPlayers sync.Mutex
+
+var announcers map[string]*Announcer // Guild ID to announcer
+var mAnnouncers sync.Mutex
 
-var cfg Config
 var logger *zap.Logger
 
+var ttsProvider TTSProvider
+
+var clipCache *ClipCache
+
+var warmer *Warmer // nil if pre-generating clips is disabled.
+
+var store *Store // Per-guild settings.
+
+var heralds *HeraldLibrary
+
 // //////////////////////////////
 // Main program.
 // //////////////////////////////
@@ -346,7 +292,7 @@ func main() {
 	}
 	defer logger.Sync()
 
-	if err := ReadConfig(&cfg); err != nil {
+	if err := reloadConfig(); err != nil {
 		fmt.Println(err)
 		if err := WriteDefaultConfig(); err != nil {
 			fmt.Println("Failed to create the default configuration file:", err)
@@ -357,29 +303,73 @@ func main() {
 		return
 	}
 
-	if cfg.Token == tokenDefaultString {
+	if cfg().Token == tokenDefaultString {
 		fmt.Println("Please set your bot token in " + configFile + " first.")
 		return
 	}
 
 	// Check if all binary dependencies are installed correctly.
 	const notInstalledErrMsg = "Unable to find %s in the specified path '%s', please make sure it's installed correctly. You can manually set its path by editing %s. Error message: %s.\n"
-	found, err := util.CheckInstalled(cfg.YtdlPath, "--version")
+	found, err := util.CheckInstalled(cfg().YtdlPath, "--version")
 	if err != nil && !found {
-		fmt.Printf(notInstalledErrMsg, "yt-dlp", cfg.YtdlPath, configFile, err)
+		fmt.Printf(notInstalledErrMsg, "yt-dlp", cfg().YtdlPath, configFile, err)
 		return
 	}
-	found, err = util.CheckInstalled(cfg.FfmpegPath, "-version")
+	found, err = util.CheckInstalled(cfg().FfmpegPath, "-version")
 	if err != nil && !found {
-		fmt.Printf(notInstalledErrMsg, "ffmpeg", cfg.FfmpegPath, configFile, err)
+		fmt.Printf(notInstalledErrMsg, "ffmpeg", cfg().FfmpegPath, configFile, err)
 		return
 	}
 
-	// Initialize client map.
+	// Set up the TTS provider.
+	ttsProvider, err = NewTTSProvider(cfg())
+	if err != nil {
+		fmt.Println("Failed to set up the TTS provider:", err)
+		return
+	}
+	if local, ok := ttsProvider.(*LocalTTS); ok {
+		found, err = util.CheckInstalled(local.Path, "--version")
+		if err != nil && !found {
+			fmt.Printf(notInstalledErrMsg, local.Engine, local.Path, configFile, err)
+			return
+		}
+	}
+	defer ttsProvider.Close()
+	if _, ok := cfg().loudnorm(); ok {
+		ttsProvider = normalizingTTS{ttsProvider}
+	}
+
+	// Open the clip cache.
+	clipCache, err = OpenClipCache(cfg().UserAudioPath, cfg().clipCacheMaxBytes(), cfg().clipCacheMaxAge())
+	if err != nil {
+		fmt.Println("Failed to open the clip cache:", err)
+		return
+	}
+
+	go PrepareFallbackClips(context.Background())
+
+	heralds = NewHeraldLibrary(cfg().AnnouncementPath)
+
+	// Start pre-generating clips.
+	if cfg().PrewarmWorkers >= 0 {
+		warmer = NewWarmer(cfg().prewarmWorkers(), cfg().prewarmPerMinute())
+	}
+
+	// Open the settings database.
+	store, err = OpenStore(cfg().DatabasePath)
+	if err != nil {
+		fmt.Println("Failed to open the settings database:", err)
+		return
+	}
+	defer store.Close()
+
+	// Initialize client, player and announcer maps.
 	clients = make(map[string]*Client)
+	players = make(map[string]*GuildPlayer)
+	announcers = make(map[string]*Announcer)
 
 	// Initialize bot.
-	dg, err := discordgo.New("Bot " + cfg.Token)
+	dg, err := discordgo.New("Bot " + cfg().Token)
 	if err != nil {
 		fmt.Println("Error creating Discord session:", err)
 		return
@@ -388,10 +378,12 @@ func main() {
 	dg.AddHandler(ready)
 	// dg.AddHandler(banAdd)
 	dg.AddHandler(messageCreate)
+	dg.AddHandler(interactionCreate)
 	dg.AddHandler(announce)
+	dg.AddHandler(guildMemberAdd)
 
 	// What information we need about guilds.
-	dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMessages | discordgo.IntentsGuildVoiceStates | discordgo.IntentsGuildBans
+	dg.Identify.Intents = discordgo.IntentsGuilds | discordgo.IntentsGuildMembers | discordgo.IntentsGuildMessages | discordgo.IntentsGuildVoiceStates | discordgo.IntentsGuildBans
 	// Open the websocket and begin listening.
 	err = dg.Open()
 	if err != nil {
@@ -402,6 +394,7 @@ func main() {
 	defer dg.Close()
 
 	logger.Info("Opened Discord websocket session.")
+	go watchConfig()
 
 	// Wait here until Ctrl+c or other term signal is received.
 	fmt.Println("Bot is now running. Press Ctrl+c to exit.")
@@ -411,6 +404,7 @@ func main() {
 
 	logger.Info("Signal received, closing Discord session.")
 	fmt.Println("Signal received, closing Discord session.")
+	clipCache.Flush()
 
 }
 
@@ -422,7 +416,26 @@ func ready(s *discordgo.Session, event *discordgo.Ready) {
 		zap.String("username", u.Username),
 		zap.String("uid", u.ID),
 	)
-	s.UpdateListeningStatus(cfg.Prefix + "help")
+	// Every guild may have its own prefix, but slash commands work everywhere.
+	s.UpdateListeningStatus("/help")
+	registerSlashCommands(s)
+
+	// Hand the settings that used to be in config.json to the guilds we are
+	// in, if we were just upgraded.
+	var guildIDs []string
+	for _, g := range event.Guilds {
+		guildIDs = append(guildIDs, g.ID)
+	}
+	if err := store.AdoptLegacySettings(guildIDs); err != nil {
+		logger.Sugar().Errorf("Error importing settings from %s: %s", configFile, err)
+	}
+	// Fetching member lists takes a while.
+	go func() {
+		MigrateGuilds(s, guildIDs)
+		for _, guildID := range guildIDs {
+			warmer.WarmGuild(s, guildID)
+		}
+	}()
 }
 
 func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
@@ -440,85 +453,68 @@ func messageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
 		return
 	}
 
-	var c *Client
-	mClients.Lock()
-	{
-		var ok bool
-		if c, ok = clients[m.GuildID]; !ok {
-			c = NewClient(s)
-			clients[m.GuildID] = c
-		}
-	}
-	mClients.Unlock()
+	c := GetClient(s, m.GuildID)
 	// Update the text and voice channels associated with the client.
-	c.UpdateChannels(g, m.Message)
+	c.UpdateChannels(g, m.ChannelID, m.Author.ID)
 
-	args, ok := CmdGetArgs(m.Content)
+	gs := GetGuildSettings(m.GuildID)
+	args, ok := CmdGetArgs(gs.Prefix, m.Content)
 	if !ok {
 		// Not a command.
 		return
 	}
 
 	if len(args) == 0 {
-		c.Messagef("No command specified. Type `%shelp` for help.", cfg.Prefix)
+		c.Messagef("No command specified. Type `%shelp` for help.", gs.Prefix)
 		return
 	}
 
-	commandLog := func(action string, m *discordgo.MessageCreate) {
-		logger.Sugar().Infof("%s command called by %s#%s in channel %s on server %.\nargs: %s",
-			action, m.Author.Username, m.Author.Discriminator, m.ChannelID, m.GuildID)
-	}
-
-	commandLogArgs := func(action string, args []string, m *discordgo.MessageCreate) {
-		logger.Sugar().Infof("%s command called by %s#%s in channel %s on server %s.\nrgs: %s",
-			action, m.Author.Username, m.Author.Discriminator, m.ChannelID, m.GuildID, fmt.Sprintf("%s", args[1:]))
-	}
-
-	argName := args[0]
-	switch argName {
-	case "join":
-		commandLog(argName, m)
-		commandJoin(s, g, c, m)
-	case "part":
-		commandLog(argName, m)
-		commandPart(s, g, c, m)
-	case "help":
-		commandLog(argName, m)
-		commandHelp(c)
-	case "play":
-		commandLogArgs(argName, args, m)
-		commandPlay(s, g, c, args[1:])
-	case "seek":
-		commandLogArgs(argName, args, m)
-		commandSeek(c, args[1:])
-	case "pos":
-		commandLogArgs(argName, args, m)
-		commandPos(c)
-	case "loop":
-		commandLog(argName, m)
-		commandLoop(c)
-	case "add":
-		commandLogArgs(argName, args, m)
-		commandAdd(c, args[1:], false)
-	case "queue":
-		commandLog(argName, m)
-		commandQueue(c)
-	case "pause":
-		commandLog(argName, m)
-		commandPause(c)
-	case "stop":
-		commandLog(argName, m)
-		commandStop(c)
-	case "skip":
-		commandLog(argName, m)
-		commandSkip(c)
-	case "delete":
-		commandLogArgs(argName, args, m)
-		commandDelete(c, args[1:])
-	case "shuffle":
-		commandLog(argName, m)
-		commandShuffle(c)
+	runCommand(s, g, c, m.Author, m.Member, m.ChannelID, args[0], args[1:], m.Attachments, nil)
+}
+
+// Runs a command, no matter whether it came in as a message or as a slash
+// command. args doesn't contain the command name. member may be nil.
+// interaction is the deferred interaction of a slash command, nil otherwise.
+func runCommand(s *discordgo.Session, g *discordgo.Guild, c *Client, author *discordgo.User, member *discordgo.Member, channelID string, name string, args []string, attachments []*discordgo.MessageAttachment, interaction *discordgo.Interaction) {
+	cmd, ok := LookupCommand(name)
+	if !ok {
+		return
 	}
+
+	logger.Sugar().Infof("%s command called by %s#%s in channel %s on server %s.\nargs: %s",
+		cmd.Name, author.Username, author.Discriminator, channelID, g.ID, fmt.Sprintf("%s", args))
+
+	ctx := &CommandContext{
+		s:           s,
+		g:           g,
+		c:           c,
+		Author:      author,
+		Member:      member,
+		ChannelID:   channelID,
+		Args:        args,
+		Attachments: attachments,
+		interaction: interaction,
+	}
+	// Some commands don't send any message; don't leave a slash command
+	// user with an eternally "thinking" bot.
+	defer func() {
+		if ctx.interaction != nil {
+			ctx.Messagef("Done.")
+		}
+	}()
+
+	if ok, required := CheckPermission(g, author.ID, member, cmd); !ok {
+		logger.Sugar().Infof("Denied %s command to %s#%s (requires %s).", cmd.Name, author.Username, author.Discriminator, required)
+		switch required {
+		case PermDJ:
+			ctx.Messagef("Sorry, you need a DJ role to use `%s`.", cmd.Name)
+		default:
+			ctx.Messagef("Sorry, only admins can use `%s`.", cmd.Name)
+		}
+		return
+	}
+
+	cmd.Run(ctx)
 }
 
 func announce(s *discordgo.Session, event *discordgo.VoiceStateUpdate) {
@@ -535,124 +531,135 @@ func announce(s *discordgo.Session, event *discordgo.VoiceStateUpdate) {
 		return
 	}
 
-	// Check if the configHash has changed and if so, update the config.
-	err = ReadConfig(&cfg)
-	if err != nil {
-		logger.Sugar().Errorf("Error: Failed to re-read config file: %s", err)
-	}
+	gs := GetGuildSettings(event.GuildID)
 
-	// Check if it's a user on the ignore list.
-	for _, ignore := range cfg.IgnoreList {
-		if member.User.Username == ignore {
-			logger.Sugar().Debugf("Ignoring %s", member.User.Username)
-			return
-		}
+	// Check if it's a user (or role) on the ignore list.
+	if gs.IsIgnored(member) {
+		logger.Sugar().Debugf("Ignoring %s", member.User.Username)
+		return
 	}
 
 	logger.Debug("Voice chat event for user: " + member.User.Username + "#" + member.User.Discriminator + ".")
 
-	// Check if user has a "custom name" set
-	isCustomUsername := false
-	var customName string
-	for userName, customUserName := range cfg.CustomNames {
-		if strings.EqualFold(member.User.Username, userName) {
-			isCustomUsername = true
-			customName = customUserName
-		}
-	}
-
-	userAnnounceName := member.User.Username
-	// Use custom name, or...
-	if isCustomUsername {
-		logger.Sugar().Infof("Real username [%s], Custom name: [%s]", member.User.Username, customName)
-		userAnnounceName = customName
-	}
-
-	join := fmt.Sprintf("%s joined.", userAnnounceName)
-	part := fmt.Sprintf("%s left.", userAnnounceName)
-	msgs := []string{join, part}
-
-	err = GetAudioFile(msgs, member.User.ID, userAnnounceName)
-	if err != nil {
-		logMessage := fmt.Sprintf("Error: failed to get audio file for user %s#%s (has custom: %s)", member.User.Username, member.User.Discriminator, strconv.FormatBool(isCustomUsername))
-		logger.Error(logMessage)
-	}
-
 	s.RLock()
 	vc := s.VoiceConnections[event.GuildID]
 	s.RUnlock()
 
-	botChannel, err := s.State.VoiceState(event.GuildID, s.State.User.ID)
-	if botChannel == nil || err != nil || vc == nil {
-		_, err := s.ChannelVoiceJoin(event.GuildID, event.ChannelID, false, true)
+	var botChannelID string
+	if botChannel, err := s.State.VoiceState(event.GuildID, s.State.User.ID); err == nil && vc != nil {
+		botChannelID = botChannel.ChannelID
+	}
+	if botChannelID == "" {
+		// The bot isn't in a voice channel yet, follow the user, unless the
+		// channel isn't announced anyway.
+		if event.ChannelID == "" || !gs.AnnouncesChannel(event.ChannelID) {
+			return
+		}
+		_, err := JoinVoiceChannel(s, event.GuildID, event.ChannelID)
 		if err != nil {
 			logger.Sugar().Errorf("Error joining voice channel %s: %s", event.ChannelID, err)
 			return
 		}
+		botChannelID = event.ChannelID
 	}
 
 	// Try to determine the type of event.
-	if err != nil {
-		logger.Sugar().Errorf("Error: Failed to get voice state of user %s (%s).", event.UserID, member.User.Username)
-		return
+	var beforeChannelID string
+	if event.BeforeUpdate != nil {
+		beforeChannelID = event.BeforeUpdate.ChannelID
 	}
-
-	if (event.BeforeUpdate == nil || event.BeforeUpdate.ChannelID != botChannel.ChannelID) && event.ChannelID == botChannel.ChannelID {
-		logger.Info("User has joined voice channel: " + member.User.Username + "#" + member.User.Discriminator + ".")
-		time.Sleep(1250 * time.Millisecond)
-
-		// // Stop the bot from trying to read multiple joins at the same time (so that it doesn't destroy our ears)
-		mPlayAudio.Lock()
-
-		botChannel.SelfMute = true
-		filename := fmt.Sprintf("%s_%s", member.User.ID, userAnnounceName)
-		announcement := util.GetHeraldSound(cfg.AnnouncementPath)
-		PlayAudioFile(s.VoiceConnections[event.GuildID], announcement, make(<-chan bool))
-		PlayAudioFile(s.VoiceConnections[event.GuildID], filepath.Join(cfg.UserAudioPath, filename)+"_join.ogg", make(<-chan bool))
-
-		mPlayAudio.Unlock()
-
-		logger.Debug("Event doesn't have a BeforeUpdate",
+	e, ok := classifyVoiceEvent(beforeChannelID, event.ChannelID, botChannelID)
+	if !ok {
+		logger.Debug("DEBUG: Events here are mute/deafen, screenshare-related, in other channels or otherwise unknown.")
+		logger.Debug("Ignoring voice state update",
 			zap.String("Member", fmt.Sprintf("%s#%s", member.User.Username, member.User.Discriminator)),
 			zap.String("Channel", event.ChannelID),
+			zap.String("BeforeState", fmt.Sprintf("%#v", event.BeforeUpdate)),
 			zap.String("CurrentState", fmt.Sprintf("%#v", event.VoiceState)),
 			zap.String("EventStruct for debugging", fmt.Sprintf("%+v", event)),
 		)
 		return
 	}
-
-	// Ignore Server/Self Mute/Deafen events.
-	if event.BeforeUpdate == nil {
-		return
-	} else if event.BeforeUpdate.Deaf != event.VoiceState.Deaf {
-		return
-	} else if event.BeforeUpdate.SelfDeaf != event.VoiceState.SelfDeaf {
-		return
-	} else if event.BeforeUpdate.Mute != event.VoiceState.Mute {
-		return
-	} else if event.BeforeUpdate.SelfMute != event.VoiceState.SelfMute {
+	if !gs.AnnouncesChannel(botChannelID) {
+		logger.Sugar().Debugf("Not announcing in voice channel %s.", botChannelID)
 		return
 	}
 
-	// Ignore messages from voice channels the bot is not in.
-	if event.BeforeUpdate.ChannelID == botChannel.ChannelID && event.ChannelID != botChannel.ChannelID {
+	switch e {
+	case announceJoin:
+		logger.Info("User has joined voice channel: " + member.User.Username + "#" + member.User.Discriminator + ".")
+	case announceLeave:
 		logger.Info("User has left voice channel: " + member.User.Username + "#" + member.User.Discriminator + ".")
+	case announceMove:
+		logger.Info("User has moved between voice channels: "+member.User.Username+"#"+member.User.Discriminator+".",
+			zap.String("from", beforeChannelID),
+			zap.String("to", event.ChannelID),
+		)
+	}
 
-		mPlayAudio.Lock()
+	data := memberAnnounceData(&gs, member)
+	if data.Name != member.User.Username {
+		logger.Sugar().Infof("Real username [%s], announced name: [%s]", member.User.Username, data.Name)
+	}
+	data.setTime(time.Now())
+	if ch, err := s.State.Channel(event.ChannelID); err == nil {
+		data.Channel = escapeSpeech(sanitizePronunciation(ch.Name))
+	}
+	if ch, err := s.State.Channel(beforeChannelID); err == nil {
+		data.FromChannel = escapeSpeech(sanitizePronunciation(ch.Name))
+	}
+	if g, err := s.State.Guild(event.GuildID); err == nil {
+		for _, vs := range g.VoiceStates {
+			if vs.ChannelID == event.ChannelID && vs.UserID != s.State.User.ID {
+				data.MemberCount++
+			}
+		}
+	}
 
-		filename := fmt.Sprintf("%s_%s", member.User.ID, userAnnounceName)
-		PlayAudioFile(s.VoiceConnections[event.GuildID], filepath.Join(cfg.UserAudioPath, filename)+"_leave.ogg", make(<-chan bool))
+	// The guild's announcer and player stop the bot from trying to read
+	// multiple joins at the same time (so that it doesn't destroy our ears).
+	GetAnnouncer(s, event.GuildID).Add(&Announcement{
+		Event:     e,
+		ChannelID: botChannelID,
+		// Arrivals in the bot's channel, including moves into it, get a
+		// herald.
+		Arrival: event.ChannelID == botChannelID,
+		UserID:  member.User.ID,
+		Data:    data,
+		Voice:   gs.VoiceFor(member.User),
+	})
+}
 
-		mPlayAudio.Unlock()
-		return
+// Returns the announcement data describing the member alone. The name is the
+// custom name, nickname, display name or username, whichever comes first in
+// the guild's name order. All names are speech markup.
+func memberAnnounceData(gs *GuildSettings, member *discordgo.Member) AnnounceData {
+	return AnnounceData{
+		Name:        gs.ResolveName(member),
+		Count:       1,
+		Username:    escapeSpeech(sanitizePronunciation(member.User.Username)),
+		Nickname:    escapeSpeech(sanitizePronunciation(member.Nick)),
+		DisplayName: escapeSpeech(sanitizePronunciation(member.User.GlobalName)),
 	}
+}
 
-	logger.Debug("DEBUG: Events here are screenshare-related or otherwise unknown.")
-	logger.Debug("Event contains a BeforeUpdate",
-		zap.String("Member", fmt.Sprintf("%s#%s", member.User.Username, member.User.Discriminator)),
-		zap.String("Channel", event.ChannelID),
-		zap.String("BeforeState", fmt.Sprintf("%#v", event.BeforeUpdate)),
-		zap.String("CurrentState", fmt.Sprintf("%#v", event.VoiceState)),
-		zap.String("EventStruct for debugging", fmt.Sprintf("%+v", event)),
-	)
+// Classifies a voice channel change relative to the bot's voice channel. An
+// empty channel ID means not being in a voice channel. A move is announced if
+// the bot is in either the source or the destination channel. Returns false if
+// the update isn't a channel change (e.g. muting or screensharing) or doesn't
+// concern the bot's channel.
+func classifyVoiceEvent(beforeChannelID, afterChannelID, botChannelID string) (AnnounceEvent, bool) {
+	if beforeChannelID == afterChannelID || botChannelID == "" {
+		return 0, false
+	}
+	if beforeChannelID != botChannelID && afterChannelID != botChannelID {
+		return 0, false
+	}
+	if beforeChannelID != "" && afterChannelID != "" {
+		return announceMove, true
+	}
+	if afterChannelID == botChannelID {
+		return announceJoin, true
+	}
+	return announceLeave, true
 }
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestClassifyVoiceEvent(t *testing.T) {
+	tests := []struct {
+		name          string
+		before, after string
+		bot           string
+		want          AnnounceEvent
+		wantOK        bool
+	}{
+		{"join", "", "A", "A", announceJoin, true},
+		{"leave", "A", "", "A", announceLeave, true},
+		{"join elsewhere", "", "B", "A", 0, false},
+		{"leave elsewhere", "B", "", "A", 0, false},
+		{"move out of the bot's channel", "A", "B", "A", announceMove, true},
+		{"move into the bot's channel", "B", "A", "A", announceMove, true},
+		{"move between other channels", "B", "C", "A", 0, false},
+		{"mute in the bot's channel", "A", "A", "A", 0, false},
+		{"deafen elsewhere", "B", "B", "A", 0, false},
+		{"bot not in a channel", "", "A", "", 0, false},
+		{"move while the bot isn't in a channel", "A", "B", "", 0, false},
+		{"update without a channel", "", "", "A", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := classifyVoiceEvent(tt.before, tt.after, tt.bot)
+		if ok != tt.wantOK || (ok && got != tt.want) {
+			t.Errorf("%s: got %s, %t; want %s, %t", tt.name, got, ok, tt.want, tt.wantOK)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+// Deciding what name a user is announced by, and making it pronounceable.
+package main
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/goproslowyo/discordgo"
+	"golang.org/x/text/unicode/norm"
+)
+
+// Sources of the announced name, as used in the name_order setting.
+const (
+	nameCustom   = "custom"   // The custom name from custom_names.
+	nameNick     = "nick"     // The guild nickname.
+	nameDisplay  = "display"  // The global display name.
+	nameUsername = "username" // The unique Discord username.
+)
+
+var defaultNameOrder = []string{nameCustom, nameNick, nameDisplay, nameUsername}
+
+// Returns the name the member is announced by as speech markup: the first name
+// in the guild's name order that is set and still pronounceable after
+// sanitizing. The username is the last resort, even if it isn't in the order.
+// Custom names that are SSML are used as they are, invalid ones are skipped.
+func (gs *GuildSettings) ResolveName(member *discordgo.Member) string {
+	order := gs.NameOrder
+	if len(order) == 0 {
+		order = defaultNameOrder
+	}
+	for _, source := range order {
+		var name string
+		switch source {
+		case nameCustom:
+			name, _ = gs.CustomName(member.User)
+			markup, err := checkName(name)
+			if err != nil {
+				logger.Sugar().Warnf("Ignoring the invalid custom name of %s: %s.", member.User.ID, err)
+				continue
+			}
+			if markup {
+				return name
+			}
+		case nameNick:
+			name = member.Nick
+		case nameDisplay:
+			name = member.User.GlobalName
+		case nameUsername:
+			name = member.User.Username
+		default:
+			logger.Sugar().Warnf("Unknown name source '%s' in name_order.", source)
+			continue
+		}
+		if name = sanitizePronunciation(name); name != "" {
+			return escapeSpeech(name)
+		}
+	}
+	if name := sanitizePronunciation(member.User.Username); name != "" {
+		return escapeSpeech(name)
+	}
+	// Nothing pronounceable at all.
+	return escapeSpeech(member.User.Username)
+}
+
+// The maximum number of times a character may repeat, e.g. "heyyyyy" is
+// spoken as "heyy".
+const maxRepeat = 2
+
+// The maximum number of combining marks on one character. Real scripts need
+// few; zalgo text piles up dozens.
+const maxMarks = 2
+
+// The generic combining diacritics zalgo text is made of. Accents used by real
+// languages are composed into their letters by NFKC, so whatever is left of
+// these is noise.
+var zalgoMarks = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{Lo: 0x0300, Hi: 0x036f, Stride: 1},
+		{Lo: 0x1ab0, Hi: 0x1aff, Stride: 1},
+		{Lo: 0x1dc0, Hi: 0x1dff, Stride: 1},
+		{Lo: 0x20d0, Hi: 0x20ff, Stride: 1},
+		{Lo: 0xfe20, Hi: 0xfe2f, Stride: 1},
+	},
+}
+
+// Makes text fit for TTS: turns "fancy fonts" like fullwidth or mathematical
+// letters into plain ones, strips emoji and other symbols, zalgo and invisible
+// characters, collapses repeated letters and punctuation (but not digits) and
+// turns separators like underscores into spaces. The result may be empty.
+func sanitizePronunciation(text string) string {
+	var b strings.Builder
+	var last rune
+	repeat, marks := 0, 0
+	for _, r := range norm.NFKC.String(text) {
+		switch {
+		case unicode.In(r, unicode.Mn, unicode.Me):
+			marks++
+			if marks > maxMarks || last == ' ' || last == 0 || unicode.Is(zalgoMarks, r) {
+				continue
+			}
+			b.WriteRune(r)
+			continue
+		case unicode.In(r, unicode.So, unicode.Sk, unicode.Cf, unicode.Co, unicode.Cs, unicode.Cc):
+			// Emoji, skin tone modifiers, joiners, variation selectors and
+			// the like.
+			continue
+		case r == '_' || r == '.' || r == '-' || r == '~' || r == '|' || unicode.IsSpace(r):
+			r = ' '
+		}
+		marks = 0
+		if r == last {
+			repeat++
+			// Numbers are read out as numbers, so every digit counts.
+			if (repeat >= maxRepeat && !unicode.IsDigit(r)) || r == ' ' {
+				continue
+			}
+		} else {
+			repeat = 0
+		}
+		b.WriteRune(r)
+		last = r
+	}
+	return strings.TrimSpace(b.String())
+}
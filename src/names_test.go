@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+func TestSanitizePronunciation(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"Alice", "Alice"},
+		{"  Alice  ", "Alice"},
+		{"🔥Alice🔥", "Alice"},
+		{"👍🏽 Bob", "Bob"},
+		{"👨‍👩‍👧", ""},
+		{"B̷̛̼o̶̱͝b̸̰̈", "Bob"},
+		{"Zoë", "Zoë"},
+		{"José", "José"},
+		{"heyyyyy", "heyy"},
+		{"!!!!!", "!!"},
+		{"1000", "1000"},
+		{"dark_knight", "dark knight"},
+		{"xX__sniper__Xx", "xX sniper Xx"},
+		{"Ａｌｉｃｅ", "Alice"},
+		{"ℌ𝔢𝔩𝔩𝔬", "Hello"},
+		{"𝐁𝐨𝐥𝐝", "Bold"},
+		{"𝓈𝒸𝓇𝒾𝓅𝓉", "script"},
+		{"A​l‍ice", "Alice"},
+	}
+	for _, tt := range tests {
+		if got := sanitizePronunciation(tt.text); got != tt.want {
+			t.Errorf("sanitizePronunciation(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestResolveName(t *testing.T) {
+	user := &discordgo.User{ID: "1", Username: "alice_1", GlobalName: "Alice Global"}
+	member := &discordgo.Member{User: user, Nick: "Ally"}
+	noNick := &discordgo.Member{User: user}
+	onlyUsername := &discordgo.Member{User: &discordgo.User{ID: "1", Username: "alice_1"}}
+	custom := GuildSettings{CustomNames: map[string]string{"1": "Alicia"}}
+
+	tests := []struct {
+		name   string
+		gs     GuildSettings
+		member *discordgo.Member
+		want   string
+	}{
+		{"custom name first", custom, member, "Alicia"},
+		{"then the nickname", GuildSettings{}, member, "Ally"},
+		{"then the display name", GuildSettings{}, noNick, "Alice Global"},
+		{"then the username", GuildSettings{}, onlyUsername, "alice 1"},
+		{"custom name by username", GuildSettings{CustomNames: map[string]string{"alice_1": "Alicia"}}, member, "Alicia"},
+		{"SSML custom name", GuildSettings{CustomNames: map[string]string{"1": `<sub alias="Alisha">Alicia</sub>`}}, member,
+			`<sub alias="Alisha">Alicia</sub>`},
+		{"plain custom name with <", GuildSettings{CustomNames: map[string]string{"1": "Al <3"}}, member, "Al &lt;3"},
+		{"invalid custom name", GuildSettings{CustomNames: map[string]string{"1": `<audio src="x"/>`}}, member, "Ally"},
+		{"unpronounceable nickname", GuildSettings{}, &discordgo.Member{User: user, Nick: "🔥🔥"}, "Alice Global"},
+		{"nothing pronounceable", GuildSettings{}, &discordgo.Member{User: &discordgo.User{ID: "1", Username: "🔥"}}, "🔥"},
+		{"custom order", GuildSettings{NameOrder: []string{nameUsername, nameNick}}, member, "alice 1"},
+		{"username as last resort", GuildSettings{NameOrder: []string{nameNick}}, noNick, "alice 1"},
+	}
+	for _, tt := range tests {
+		if got := tt.gs.ResolveName(tt.member); got != tt.want {
+			t.Errorf("%s: ResolveName() = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
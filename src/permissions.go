@@ -0,0 +1,80 @@
+// Role based permissions for commands.
+package main
+
+import (
+	"slices"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+// GuildPermissions configures who may run which commands in a guild.
+type GuildPermissions struct {
+	DJRoles    []string `json:"dj_roles"`    // Role IDs.
+	AdminRoles []string `json:"admin_roles"` // Role IDs.
+	// Command name to minimum role ("everyone", "dj" or "admin"), overriding
+	// the command's default.
+	Commands map[string]string `json:"commands"`
+}
+
+func parsePermission(s string) (Permission, bool) {
+	for _, p := range []Permission{PermEveryone, PermDJ, PermAdmin} {
+		if p.String() == s {
+			return p, true
+		}
+	}
+	return PermEveryone, false
+}
+
+// Returns the minimum role needed to run cmd in the guild.
+func (gp *GuildPermissions) required(cmd *Command) Permission {
+	if s, ok := gp.Commands[cmd.Name]; ok {
+		if p, ok := parsePermission(s); ok {
+			return p
+		}
+		logger.Sugar().Warnf("Invalid permission '%s' for command %s, using the default.", s, cmd.Name)
+	}
+	// Without any DJ roles configured, DJ commands are open to everyone, as
+	// they were before permissions existed.
+	if cmd.Permission == PermDJ && len(gp.DJRoles) == 0 {
+		return PermEveryone
+	}
+	return cmd.Permission
+}
+
+// Returns the highest permission level of the member. The guild owner and
+// members with the Administrator or Manage Server permission are always admins.
+func memberPermission(g *discordgo.Guild, gp *GuildPermissions, userID string, member *discordgo.Member) Permission {
+	if g.OwnerID == userID {
+		return PermAdmin
+	}
+	if member == nil {
+		return PermEveryone
+	}
+
+	perm := PermEveryone
+	for _, roleID := range member.Roles {
+		if slices.Contains(gp.AdminRoles, roleID) {
+			return PermAdmin
+		}
+		if slices.Contains(gp.DJRoles, roleID) {
+			perm = PermDJ
+		}
+		for _, role := range g.Roles {
+			if role.ID == roleID && role.Permissions&(discordgo.PermissionAdministrator|discordgo.PermissionManageServer) != 0 {
+				return PermAdmin
+			}
+		}
+	}
+	return perm
+}
+
+// Reports whether the user may run cmd. If not, the returned permission is
+// the one that would have been needed.
+func CheckPermission(g *discordgo.Guild, userID string, member *discordgo.Member, cmd *Command) (bool, Permission) {
+	gp := GetGuildSettings(g.ID).Permissions
+	required := gp.required(cmd)
+	if required == PermEveryone {
+		return true, required
+	}
+	return memberPermission(g, &gp, userID, member) >= required, required
+}
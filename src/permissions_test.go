@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+func TestRequiredPermission(t *testing.T) {
+	open := &Command{Name: "queue"}
+	dj := &Command{Name: "skip", Permission: PermDJ}
+	admin := &Command{Name: "settings", Permission: PermAdmin}
+
+	tests := []struct {
+		name string
+		gp   GuildPermissions
+		cmd  *Command
+		want Permission
+	}{
+		{"no DJ roles open DJ commands", GuildPermissions{}, dj, PermEveryone},
+		{"admin roles don't affect DJ commands", GuildPermissions{AdminRoles: []string{"1"}}, dj, PermEveryone},
+		{"DJ roles restrict DJ commands", GuildPermissions{DJRoles: []string{"1"}}, dj, PermDJ},
+		{"admin commands without roles", GuildPermissions{}, admin, PermAdmin},
+		{"admin commands with DJ roles", GuildPermissions{DJRoles: []string{"1"}}, admin, PermAdmin},
+		{"commands for everyone", GuildPermissions{DJRoles: []string{"1"}}, open, PermEveryone},
+		{"override restricting a command",
+			GuildPermissions{Commands: map[string]string{"queue": "admin"}}, open, PermAdmin},
+		{"override opening an admin command",
+			GuildPermissions{Commands: map[string]string{"settings": "everyone"}}, admin, PermEveryone},
+		// An override applies even without DJ roles.
+		{"override to DJ",
+			GuildPermissions{Commands: map[string]string{"queue": "dj"}}, open, PermDJ},
+		{"override of another command",
+			GuildPermissions{DJRoles: []string{"1"}, Commands: map[string]string{"queue": "admin"}}, dj, PermDJ},
+		{"invalid override",
+			GuildPermissions{Commands: map[string]string{"settings": "nobody"}}, admin, PermAdmin},
+	}
+	for _, tt := range tests {
+		if got := tt.gp.required(tt.cmd); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMemberPermission(t *testing.T) {
+	g := &discordgo.Guild{
+		OwnerID: "owner",
+		Roles: []*discordgo.Role{
+			{ID: "mods", Permissions: discordgo.PermissionManageServer},
+			{ID: "djs"},
+			{ID: "bosses"},
+			{ID: "fans"},
+		},
+	}
+	gp := &GuildPermissions{DJRoles: []string{"djs"}, AdminRoles: []string{"bosses"}}
+	member := func(roles ...string) *discordgo.Member {
+		return &discordgo.Member{Roles: roles}
+	}
+
+	tests := []struct {
+		name   string
+		userID string
+		member *discordgo.Member
+		want   Permission
+	}{
+		{"owner", "owner", nil, PermAdmin},
+		{"unknown member", "1", nil, PermEveryone},
+		{"no roles", "1", member(), PermEveryone},
+		{"other roles", "1", member("fans"), PermEveryone},
+		{"DJ role", "1", member("fans", "djs"), PermDJ},
+		{"admin role", "1", member("djs", "bosses"), PermAdmin},
+		{"manage server", "1", member("mods"), PermAdmin},
+	}
+	for _, tt := range tests {
+		if got := memberPermission(g, gp, tt.userID, tt.member); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+// The command registry. Dispatching, the help message and the slash command
+// definitions are all derived from it, so they can't get out of sync.
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/goproslowyo/discordgo"
+)
+
+// Permission is the minimum role a guild member needs to run a command.
+type Permission int
+
+const (
+	PermEveryone Permission = iota
+	PermDJ
+	PermAdmin
+)
+
+func (p Permission) String() string {
+	switch p {
+	case PermEveryone:
+		return "everyone"
+	case PermDJ:
+		return "dj"
+	case PermAdmin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// CommandContext holds everything a command may need. It is only used by the
+// goroutine running the command.
+type CommandContext struct {
+	s         *discordgo.Session
+	g         *discordgo.Guild
+	c         *Client
+	Author    *discordgo.User
+	Member    *discordgo.Member // May be nil.
+	ChannelID string
+	Args      []string // Arguments, without the command name.
+	// Files attached to the message, or passed as attachment options.
+	Attachments []*discordgo.MessageAttachment
+
+	// The deferred interaction of a slash command, until the first reply
+	// answers it.
+	interaction *discordgo.Interaction
+}
+
+// Replies to the command. The first reply answers the slash command that ran
+// it, everything else goes to the channel the command was sent in.
+func (ctx *CommandContext) Messagef(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if i := ctx.interaction; i != nil {
+		ctx.interaction = nil
+		_, err := ctx.s.InteractionResponseEdit(i, &discordgo.WebhookEdit{
+			Content: &msg,
+		})
+		if err == nil {
+			return
+		}
+		logger.Sugar().Errorf("Error responding to interaction: %s", err)
+	}
+	ctx.s.ChannelMessageSend(ctx.ChannelID, msg)
+}
+
+type Command struct {
+	Name    string
+	Aliases []string
+	// Arguments as shown in the help message, e.g. "<ID> <ID>".
+	Usage       string
+	Description string
+	// Argument schema of the slash command. String options are split into
+	// words and user options become mentions, passed as Args in the declared
+	// order.
+	Options []*discordgo.ApplicationCommandOption
+	// Whether the last option is free text like JSON or SSML, which is passed
+	// as one argument as it was typed instead of being split into words.
+	TextOption bool
+	Permission Permission
+	Run        func(ctx *CommandContext)
+}
+
+// //////////////////////////////
+// Global variables.
+// //////////////////////////////
+var commands []*Command
+var commandsByName map[string]*Command // Includes aliases.
+
+func stringOption(name, desc string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionString,
+		Name:        name,
+		Description: desc,
+		Required:    required,
+	}
+}
+
+// Integer options are passed to commands as decimal numbers.
+func integerOption(name, desc string, min, max int, required bool) *discordgo.ApplicationCommandOption {
+	minValue := float64(min)
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionInteger,
+		Name:        name,
+		Description: desc,
+		Required:    required,
+		MinValue:    &minValue,
+		MaxValue:    float64(max),
+	}
+}
+
+// User options are passed to commands as mentions.
+func userOption(name, desc string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionUser,
+		Name:        name,
+		Description: desc,
+		Required:    required,
+	}
+}
+
+// Role options are passed to commands as role mentions.
+func roleOption(name, desc string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionRole,
+		Name:        name,
+		Description: desc,
+		Required:    required,
+	}
+}
+
+func attachmentOption(name, desc string, required bool) *discordgo.ApplicationCommandOption {
+	return &discordgo.ApplicationCommandOption{
+		Type:        discordgo.ApplicationCommandOptionAttachment,
+		Name:        name,
+		Description: desc,
+		Required:    required,
+	}
+}
+
+// The registry is filled in init() because the help command refers back to
+// it.
+func init() {
+	commands = []*Command{
+		{
+			Name:        "help",
+			Description: "show this page",
+			Run:         commandHelp,
+		},
+		{
+			Name:        "join",
+			Description: "join your voice channel",
+			Run:         func(ctx *CommandContext) { commandJoin(ctx.s, ctx.g, ctx.c) },
+		},
+		{
+			Name:        "part",
+			Aliases:     []string{"leave"},
+			Description: "leave the voice channel",
+			Permission:  PermDJ,
+			Run:         func(ctx *CommandContext) { commandPart(ctx.s, ctx.g, ctx.c) },
+		},
+		{
+			Name:        "play",
+			Aliases:     []string{"p"},
+			Usage:       "[URL|query]",
+			Description: "play audio from a URL or a youtube search query; without arguments, start playing the queue/resume playback",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("query", "URL or youtube search query", false),
+			},
+			Run: commandPlay,
+		},
+		{
+			Name:        "seek",
+			Usage:       "[+|-]<time>",
+			Description: "seek to the specified time (format: mm:ss or seconds, +/- for relative)",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("time", "mm:ss or seconds, +30 or -10 to seek relative", true),
+			},
+			Run: commandSeek,
+		},
+		{
+			Name:        "pos",
+			Aliases:     []string{"np"},
+			Description: "get the current playback time",
+			Run:         commandPos,
+		},
+		{
+			Name:        "loop",
+			Description: "start/stop looping the current track",
+			Run:         commandLoop,
+		},
+		{
+			Name:        "volume",
+			Aliases:     []string{"vol"},
+			Usage:       "[music|announce] [0-200]",
+			Description: "show or change the volume of music or (admins only) announcements, in percent",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("target", "music (default) or announce", false),
+				integerOption("volume", "0-200", 0, maxVolume, false),
+			},
+			Permission: PermDJ,
+			Run:        commandVolume,
+		},
+		{
+			Name:        "add",
+			Usage:       "<URL|query>",
+			Description: "add a URL or a youtube search query to the queue; note: be patient when adding large playlists",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("query", "URL or youtube search query", true),
+			},
+			Run: func(ctx *CommandContext) { commandAdd(ctx, ctx.Args, false) },
+		},
+		{
+			Name:        "queue",
+			Aliases:     []string{"q"},
+			Description: "print the current queue; used to obtain track IDs for some other commands",
+			Run:         commandQueue,
+		},
+		{
+			Name:        "pause",
+			Description: "pause playback",
+			Run:         commandPause,
+		},
+		{
+			Name:        "stop",
+			Description: "clear playlist and stop playback",
+			Permission:  PermDJ,
+			Run:         commandStop,
+		},
+		{
+			Name:        "skip",
+			Description: "skip the current track",
+			Run:         commandSkip,
+		},
+		{
+			Name:        "delete",
+			Aliases:     []string{"rm"},
+			Usage:       "<ID|ID-ID>...",
+			Description: "delete one or multiple tracks from the queue",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("ids", "track IDs or ranges separated by spaces, e.g. 1 3-5", true),
+			},
+			Permission: PermDJ,
+			Run:        commandDelete,
+		},
+		{
+			Name:        "swap",
+			Usage:       "<ID> <ID>",
+			Description: "swap the position of two tracks in the queue",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("first", "track ID", true),
+				stringOption("second", "track ID", true),
+			},
+			Run: commandSwap,
+		},
+		{
+			Name:        "shuffle",
+			Description: "shuffle all items in the current queue",
+			Permission:  PermDJ,
+			Run:         commandShuffle,
+		},
+		{
+			Name:        "setname",
+			Usage:       "[@user] <name>",
+			Description: "set the name you are announced by; admins can set anyone's",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("name", "name to announce", true),
+				userOption("user", "user to change (admins only)", false),
+			},
+			Run: commandSetName,
+		},
+		{
+			Name:        "clearname",
+			Usage:       "[@user]",
+			Description: "go back to being announced by your username",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption("user", "user to change (admins only)", false),
+			},
+			Run: commandClearName,
+		},
+		{
+			Name:        "ignore",
+			Usage:       "[@user|@role]",
+			Description: "stop announcing you when you join or leave; admins can ignore other users and whole roles",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption("user", "user to change (admins only)", false),
+				roleOption("role", "role to ignore (admins only)", false),
+			},
+			Run: commandIgnore,
+		},
+		{
+			Name:        "unignore",
+			Usage:       "[@user|@role]",
+			Description: "announce you again",
+			Options: []*discordgo.ApplicationCommandOption{
+				userOption("user", "user to change (admins only)", false),
+				roleOption("role", "role to stop ignoring (admins only)", false),
+			},
+			Run: commandUnignore,
+		},
+		{
+			Name:        "announceopts",
+			Usage:       "[@user] [lang=<code>] [voice=<name>] [rate=<n>] [pitch=<n>]|[reset]",
+			Description: "show or change the voice you are announced with",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("options", "lang=<code> voice=<name> rate=<0.25-4> pitch=<-20-20>, or reset", false),
+				userOption("user", "user to change (admins only)", false),
+			},
+			Run: commandAnnounceOpts,
+		},
+		{
+			Name:        "preview",
+			Usage:       "[text]",
+			Description: "hear how you are announced, or how text (which may be SSML) is spoken, in your voice channel",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("text", "text or SSML to speak instead of your join announcement", false),
+			},
+			TextOption: true,
+			Run:        commandPreview,
+		},
+		{
+			Name:        "cache",
+			Usage:       "stats|purge",
+			Description: "show statistics of the announcement clip cache, or delete all clips",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("action", "stats or purge", true),
+			},
+			Permission: PermAdmin,
+			Run:        commandCache,
+		},
+		{
+			Name:        "settings",
+			Usage:       "[get <key>|set <key> <JSON value>|reset <key>]",
+			Description: "show or change the settings of this server",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("action", "get, set or reset", false),
+				stringOption("key", "name of the setting", false),
+				stringOption("value", "JSON value, for set", false),
+			},
+			TextOption: true,
+			Permission: PermAdmin,
+			Run:        commandSettings,
+		},
+		{
+			Name:        "heralds",
+			Description: "list the sets of herald sounds played when someone joins",
+			Run:         commandHeralds,
+		},
+		{
+			Name:        "setsound",
+			Usage:       "[@user] join|leave [replace|after]",
+			Description: "play the attached audio file instead of, or after, your announcement",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("event", "join or leave", true),
+				attachmentOption("sound", "audio file of at most 10 seconds", true),
+				stringOption("mode", "replace (default) or after the spoken announcement", false),
+				userOption("user", "user to change (admins only)", false),
+			},
+			Run: commandSetSound,
+		},
+		{
+			Name:        "clearsound",
+			Usage:       "[@user] join|leave",
+			Description: "go back to a spoken join or leave announcement",
+			Options: []*discordgo.ApplicationCommandOption{
+				stringOption("event", "join or leave", true),
+				userOption("user", "user to change (admins only)", false),
+			},
+			Run: commandClearSound,
+		},
+	}
+
+	commandsByName = make(map[string]*Command)
+	for _, cmd := range commands {
+		commandsByName[cmd.Name] = cmd
+		for _, alias := range cmd.Aliases {
+			commandsByName[alias] = cmd
+		}
+	}
+}
+
+// Returns the command with the given name or alias.
+func LookupCommand(name string) (*Command, bool) {
+	cmd, ok := commandsByName[strings.ToLower(name)]
+	return cmd, ok
+}
+
+// Generates the slash command definitions from the registry. Aliases are not
+// registered as separate slash commands.
+func slashCommandDefinitions() []*discordgo.ApplicationCommand {
+	var defs []*discordgo.ApplicationCommand
+	for _, cmd := range commands {
+		// Slash command descriptions start with a capital letter and may not
+		// be longer than 100 characters.
+		desc := strings.ToUpper(cmd.Description[:1]) + cmd.Description[1:]
+		if len(desc) > 100 {
+			desc = desc[:97] + "..."
+		}
+		defs = append(defs, &discordgo.ApplicationCommand{
+			Name:        cmd.Name,
+			Description: desc,
+			Options:     cmd.Options,
+		})
+	}
+	return defs
+}
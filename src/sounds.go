@@ -0,0 +1,272 @@
+// Custom join and leave sounds uploaded by users.
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goproslowyo/discordgo"
+	"go.uber.org/zap"
+)
+
+// Limits of uploaded sounds.
+const (
+	maxSoundBytes    = 4 << 20
+	maxSoundDuration = 10 * time.Second
+)
+
+// UserSound is a sound a user uploaded for an event.
+type UserSound struct {
+	// Whether the sound is played after the TTS announcement instead of
+	// replacing it.
+	AfterTTS bool `json:"after_tts"`
+}
+
+type UserSounds struct {
+	Join  *UserSound `json:"join,omitempty"`
+	Leave *UserSound `json:"leave,omitempty"`
+}
+
+// Returns the user's sound for the event, or nil if they don't have one.
+func (gs *GuildSettings) UserSound(userID string, e AnnounceEvent) *UserSound {
+	sounds := gs.Sounds[userID]
+	switch e {
+	case announceJoin:
+		return sounds.Join
+	case announceLeave:
+		return sounds.Leave
+	}
+	return nil
+}
+
+// Sounds are stored per guild, as they are part of the guild's settings.
+func userSoundPath(guildID, userID string, e AnnounceEvent) string {
+	return filepath.Join(cfg().soundsPath(), guildID, userID+"_"+e.String()+".ogg")
+}
+
+// //////////////////////////////
+// Downloading and transcoding.
+// //////////////////////////////
+var soundClient = &http.Client{Timeout: 30 * time.Second}
+
+func downloadAttachment(ctx context.Context, a *discordgo.MessageAttachment) ([]byte, error) {
+	if a.Size > maxSoundBytes {
+		return nil, fmt.Errorf("the file is larger than %d MB", maxSoundBytes>>20)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, a.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := soundClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("download failed: %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxSoundBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxSoundBytes {
+		return nil, fmt.Errorf("the file is larger than %d MB", maxSoundBytes>>20)
+	}
+	return data, nil
+}
+
+var ffmpegDurationRegex = regexp.MustCompile(`Duration: (\d+):(\d\d):(\d\d(?:\.\d+)?)`)
+
+// Transcodes an uploaded sound to Ogg/Opus like the TTS clips, rejecting
+// anything that isn't audio or is too long.
+func transcodeSound(ctx context.Context, input []byte) ([]byte, error) {
+	// Some containers can't be read from a pipe, so the input goes into a
+	// temporary file.
+	f, err := os.CreateTemp("", "trumpet-sound-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(input)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, cfg().FfmpegPath,
+		"-hide_banner",
+		"-i", f.Name(),
+		"-vn",
+		"-t", strconv.Itoa(int(maxSoundDuration/time.Second)+1),
+		"-c:a", "libopus",
+		"-b:a", "96k",
+		"-f", "ogg",
+		"pipe:1")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		logger.Debug("ffmpeg failed to transcode sound", zap.String("stderr", stderr.String()))
+		return nil, errors.New("that doesn't look like an audio file")
+	}
+
+	m := ffmpegDurationRegex.FindStringSubmatch(stderr.String())
+	if m == nil {
+		return nil, errors.New("couldn't determine the duration of the sound")
+	}
+	hours, _ := strconv.Atoi(m[1])
+	mins, _ := strconv.Atoi(m[2])
+	secs, _ := strconv.ParseFloat(m[3], 64)
+	duration := time.Duration(hours)*time.Hour + time.Duration(mins)*time.Minute + time.Duration(secs*float64(time.Second))
+	if duration > maxSoundDuration {
+		return nil, fmt.Errorf("the sound is %.1f seconds long, the maximum is %d", duration.Seconds(), int(maxSoundDuration/time.Second))
+	}
+	if stdout.Len() == 0 {
+		return nil, errors.New("the file doesn't contain any audio")
+	}
+	return stdout.Bytes(), nil
+}
+
+// //////////////////////////////
+// The actual commands.
+// //////////////////////////////
+func parseSoundEvent(s string) (AnnounceEvent, bool) {
+	switch strings.ToLower(s) {
+	case "join":
+		return announceJoin, true
+	case "leave":
+		return announceLeave, true
+	}
+	return 0, false
+}
+
+func commandSetSound(ctx *CommandContext) {
+	const usage = "Usage: `setsound [@user] join|leave [replace|after]`, with an audio file attached. `after` plays the sound after the spoken announcement instead of replacing it."
+	user, args, ok := settingsTarget(ctx)
+	if !ok {
+		return
+	}
+	if len(args) < 1 || len(args) > 2 {
+		ctx.Messagef(usage)
+		return
+	}
+	e, ok := parseSoundEvent(args[0])
+	if !ok {
+		ctx.Messagef(usage)
+		return
+	}
+	after := false
+	if len(args) == 2 {
+		switch args[1] {
+		case "replace":
+		case "after":
+			after = true
+		default:
+			ctx.Messagef(usage)
+			return
+		}
+	}
+	if len(ctx.Attachments) == 0 {
+		ctx.Messagef("Please attach an audio file of at most %d seconds. %s", int(maxSoundDuration/time.Second), usage)
+		return
+	}
+
+	c, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	data, err := downloadAttachment(c, ctx.Attachments[0])
+	if err == nil {
+		data, err = transcodeSound(c, data)
+	}
+	if err != nil {
+		ctx.Messagef("Can't use that sound: %s.", dcSanitize(err.Error()))
+		return
+	}
+	if _, ok := cfg().loudnorm(); ok {
+		if normalized, err := normalizeAudio(c, data); err == nil {
+			data = normalized
+		} else {
+			logger.Warn("Failed to normalize sound", zap.Error(err))
+		}
+	}
+
+	path := userSoundPath(ctx.g.ID, user.ID, e)
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err == nil {
+		if err = os.WriteFile(path+".tmp", data, 0640); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		logger.Error("Failed to save sound", zap.String("path", path), zap.Error(err))
+		ctx.Messagef("Error saving the sound.")
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		if gs.Sounds == nil {
+			gs.Sounds = make(map[string]UserSounds)
+		}
+		sounds := gs.Sounds[user.ID]
+		if e == announceJoin {
+			sounds.Join = &UserSound{AfterTTS: after}
+		} else {
+			sounds.Leave = &UserSound{AfterTTS: after}
+		}
+		gs.Sounds[user.ID] = sounds
+	}) {
+		return
+	}
+	how := "instead of"
+	if after {
+		how = "after"
+	}
+	ctx.Messagef("The sound will be played %s the %s announcement of %s.", how, e, dcSanitize(user.Username))
+}
+
+func commandClearSound(ctx *CommandContext) {
+	const usage = "Usage: `clearsound [@user] join|leave`."
+	user, args, ok := settingsTarget(ctx)
+	if !ok {
+		return
+	}
+	if len(args) != 1 {
+		ctx.Messagef(usage)
+		return
+	}
+	e, ok := parseSoundEvent(args[0])
+	if !ok {
+		ctx.Messagef(usage)
+		return
+	}
+	if !saveSettings(ctx, func(gs *GuildSettings) {
+		sounds := gs.Sounds[user.ID]
+		if e == announceJoin {
+			sounds.Join = nil
+		} else {
+			sounds.Leave = nil
+		}
+		if sounds.Join == nil && sounds.Leave == nil {
+			delete(gs.Sounds, user.ID)
+		} else {
+			gs.Sounds[user.ID] = sounds
+		}
+	}) {
+		return
+	}
+	path := userSoundPath(ctx.g.ID, user.ID, e)
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error("Failed to remove sound", zap.String("path", path), zap.Error(err))
+	}
+	ctx.Messagef("%s will be announced without a %s sound.", dcSanitize(user.Username), e)
+}
@@ -0,0 +1,322 @@
+// SSML support. Announcements are rendered as speech markup: plain text that
+// may contain SSML tags, coming from templates and custom names. Depending on
+// the TTS provider, the markup is turned into an SSML document or back into
+// plain text, and the guild's pronunciation dictionary is applied either way.
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Pronunciation tells the TTS provider how to say a word.
+type Pronunciation struct {
+	// The pronunciation in the International Phonetic Alphabet, e.g.
+	// "ˈʃɪvɔːn". Only used by providers supporting SSML.
+	IPA string `json:"ipa"`
+	// A spelling that is pronounced correctly, e.g. "Shivawn". Used if IPA
+	// isn't set or the provider doesn't support SSML.
+	Alias string `json:"alias"`
+}
+
+// Reports whether s contains SSML tags, as opposed to plain text.
+func isMarkup(s string) bool {
+	return strings.ContainsRune(s, '<')
+}
+
+// Escapes plain text so that it can be embedded into speech markup.
+func escapeSpeech(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// Elements whose content must not be changed by the pronunciation
+// dictionary, as it already says how to pronounce it.
+var pronouncedElements = map[string]bool{
+	"phoneme": true,
+	"sub":     true,
+	"say-as":  true,
+}
+
+// The elements speech markup may contain. Everything else is rejected, in
+// particular <audio>, which makes the provider fetch a URL.
+var speechElements = map[string]bool{
+	"speak":    true,
+	"phoneme":  true,
+	"sub":      true,
+	"say-as":   true,
+	"emphasis": true,
+	"prosody":  true,
+	"break":    true,
+}
+
+// The longest pause a <break> may make.
+const maxBreak = 2 * time.Second
+
+// The slowest speaking rate <prosody> may set, in percent.
+const minProsodyRate = 50
+
+var errSpeechNotAllowed = errors.New("unsupported SSML")
+
+// Returns an error if the element isn't allowed in speech markup.
+func checkSpeechElement(t xml.StartElement) error {
+	if !speechElements[t.Name.Local] {
+		return fmt.Errorf("%w: <%s> isn't allowed", errSpeechNotAllowed, t.Name.Local)
+	}
+	for _, attr := range t.Attr {
+		switch {
+		case t.Name.Local == "break" && attr.Name.Local == "time":
+			if d, err := parseBreakTime(attr.Value); err != nil || d > maxBreak {
+				return fmt.Errorf("%w: breaks may be at most %s long", errSpeechNotAllowed, maxBreak)
+			}
+		case t.Name.Local == "prosody" && attr.Name.Local == "rate":
+			percent, isPercent := strings.CutSuffix(attr.Value, "%")
+			rate, err := strconv.ParseFloat(percent, 64)
+			if isPercent && (err != nil || rate < minProsodyRate) {
+				return fmt.Errorf("%w: the rate must be at least %d%%", errSpeechNotAllowed, minProsodyRate)
+			}
+		}
+	}
+	return nil
+}
+
+// Parses the time of a <break>, like "500ms" or "2s".
+func parseBreakTime(s string) (time.Duration, error) {
+	if !strings.HasSuffix(s, "ms") && !strings.HasSuffix(s, "s") {
+		return 0, errors.New("unknown unit")
+	}
+	return time.ParseDuration(s)
+}
+
+// Returns the total time of the <break> elements in the tokens.
+func breakTime(tokens []xml.Token) time.Duration {
+	var total time.Duration
+	for _, tok := range tokens {
+		if t, ok := tok.(xml.StartElement); ok && t.Name.Local == "break" {
+			for _, attr := range t.Attr {
+				if d, err := parseBreakTime(attr.Value); attr.Name.Local == "time" && err == nil {
+					total += d
+				}
+			}
+		}
+	}
+	return total
+}
+
+var entityPattern = regexp.MustCompile(`^&(#[0-9]+|#x[0-9a-fA-F]+|[a-zA-Z][a-zA-Z0-9]*);`)
+
+// Escapes the ampersands that don't start an entity, like in "Tom & Jerry".
+func escapeStrayAmpersands(s string) string {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '&')
+		if i < 0 {
+			break
+		}
+		b.WriteString(s[:i+1])
+		if !entityPattern.MatchString(s[i:]) {
+			b.WriteString("amp;")
+		}
+		s = s[i+1:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// Parses speech markup. The parser is lenient about stray ampersands in
+// templates, but tags have to be balanced and only speechElements are
+// allowed.
+func parseSpeech(markup string) ([]xml.Token, error) {
+	if !strings.HasPrefix(strings.TrimSpace(markup), "<speak") {
+		markup = "<speak>" + markup + "</speak>"
+	}
+	// The decoder's non-strict mode would also close unbalanced tags
+	// silently, so only the ampersands are fixed.
+	d := xml.NewDecoder(strings.NewReader(escapeStrayAmpersands(markup)))
+	d.Entity = xml.HTMLEntity
+	var tokens []xml.Token
+	depth := 0
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if err := checkSpeechElement(t); err != nil {
+				return nil, err
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		case xml.CharData:
+		default:
+			// Comments, processing instructions and directives.
+			continue
+		}
+		tokens = append(tokens, xml.CopyToken(tok))
+	}
+	if depth != 0 {
+		return nil, errors.New("unbalanced SSML tags")
+	}
+	return tokens, nil
+}
+
+// The maximum length of a custom name in characters, including SSML tags.
+const maxNameLength = 100
+
+// Checks a custom name and reports whether it is speech markup. Names starting
+// with <speak are markup, others only if they parse as such; a name like
+// "Bob <3" is plain text. Markup names must only use the allowed elements and
+// pause for at most maxBreak in total.
+func checkName(name string) (markup bool, err error) {
+	if len([]rune(name)) > maxNameLength {
+		return false, fmt.Errorf("names may be at most %d characters long", maxNameLength)
+	}
+	if !isMarkup(name) {
+		return false, nil
+	}
+	tokens, err := parseSpeech(name)
+	if err != nil {
+		if errors.Is(err, errSpeechNotAllowed) || strings.HasPrefix(strings.TrimSpace(name), "<speak") {
+			return true, err
+		}
+		return false, nil
+	}
+	if breakTime(tokens) > maxBreak {
+		return true, fmt.Errorf("%w: names may pause for at most %s", errSpeechNotAllowed, maxBreak)
+	}
+	return true, nil
+}
+
+// Turns speech markup into what is sent to the TTS provider: an SSML document
+// if the provider supports it, plain text otherwise. Words in dict (keyed by
+// lowercase word) get their pronunciation; in plain text, that is their alias.
+func renderSpeech(markup string, dict map[string]Pronunciation, ssml bool) (string, error) {
+	tokens, err := parseSpeech(markup)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	// The number of open elements whose content is left alone, and in plain
+	// text, the number of open elements whose content is skipped.
+	pronounced, skipped := 0, 0
+	for _, tok := range tokens {
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if pronouncedElements[t.Name.Local] {
+				pronounced++
+			}
+			if ssml {
+				writeStartElement(&b, t)
+				continue
+			}
+			if skipped > 0 {
+				skipped++
+				continue
+			}
+			switch t.Name.Local {
+			case "sub":
+				// Speak the alias instead of the content.
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "alias" {
+						b.WriteString(attr.Value)
+						skipped = 1
+					}
+				}
+			case "break":
+				b.WriteString(" ")
+			}
+		case xml.EndElement:
+			if pronouncedElements[t.Name.Local] {
+				pronounced--
+			}
+			if ssml {
+				b.WriteString("</" + t.Name.Local + ">")
+			} else if skipped > 0 {
+				skipped--
+			}
+		case xml.CharData:
+			if !ssml && skipped > 0 {
+				continue
+			}
+			text := string(t)
+			if pronounced == 0 {
+				text = applyPronunciations(text, dict, ssml)
+			} else if ssml {
+				text = escapeSpeech(text)
+			}
+			b.WriteString(text)
+		}
+	}
+	if !ssml {
+		return strings.Join(strings.Fields(b.String()), " "), nil
+	}
+	return b.String(), nil
+}
+
+func writeStartElement(b *strings.Builder, t xml.StartElement) {
+	b.WriteString("<" + t.Name.Local)
+	for _, attr := range t.Attr {
+		b.WriteString(" " + attr.Name.Local + `="`)
+		xml.EscapeText(b, []byte(attr.Value))
+		b.WriteString(`"`)
+	}
+	b.WriteString(">")
+}
+
+// Replaces the words of text that are in dict. The result is escaped for SSML
+// if ssml is set.
+func applyPronunciations(text string, dict map[string]Pronunciation, ssml bool) string {
+	var b strings.Builder
+	isWordRune := func(r rune) bool { return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '\'' }
+	for len(text) > 0 {
+		// Split off the next run of word or non-word characters.
+		runes := []rune(text)
+		inWord := isWordRune(runes[0])
+		n := 0
+		for n < len(runes) && isWordRune(runes[n]) == inWord {
+			n++
+		}
+		part := string(runes[:n])
+		text = string(runes[n:])
+
+		p, ok := dict[strings.ToLower(part)]
+		switch {
+		case !inWord || !ok:
+			if ssml {
+				part = escapeSpeech(part)
+			}
+		case ssml && p.IPA != "":
+			part = `<phoneme alphabet="ipa" ph="` + escapeSpeech(p.IPA) + `">` + escapeSpeech(part) + "</phoneme>"
+		case ssml && p.Alias != "":
+			part = `<sub alias="` + escapeSpeech(p.Alias) + `">` + escapeSpeech(part) + "</sub>"
+		case p.Alias != "":
+			part = p.Alias
+		}
+		b.WriteString(part)
+	}
+	return b.String()
+}
+
+// Turns speech markup into what is sent to the TTS provider, using the
+// guild's pronunciation dictionary.
+func (gs *GuildSettings) Speech(markup string) (string, error) {
+	dict := make(map[string]Pronunciation, len(gs.Pronunciations))
+	for word, p := range gs.Pronunciations {
+		dict[strings.ToLower(word)] = p
+	}
+	return renderSpeech(markup, dict, ttsProvider.SupportsSSML())
+}
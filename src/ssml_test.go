@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseSpeech(t *testing.T) {
+	tests := []struct {
+		markup     string
+		wantTokens int
+		wantErr    bool
+	}{
+		{"Alice", 3, false},
+		{"<speak>Alice</speak>", 3, false},
+		{`<emphasis><sub alias="Shivawn">Siobhan</sub></emphasis> joined`, 8, false},
+		{`Alice<break time="500ms"/>`, 5, false},
+		{"Tom & Jerry", 3, false},
+		{"AT&T &amp; Tom &#233;", 3, false},
+		{"<emphasis>Alice", 0, true},
+		{"Alice</emphasis>", 0, true},
+		{"<emphasis><prosody>Alice</emphasis></prosody>", 0, true},
+		{`<audio src="http://example.com/a.mp3"/>`, 0, true},
+		{"<b>Alice</b>", 0, true},
+		{`<break time="10s"/>`, 0, true},
+		{`<break time="1m"/>`, 0, true},
+		{`<prosody rate="20%">Alice</prosody>`, 0, true},
+		{`<prosody rate="slow">Alice</prosody>`, 5, false},
+	}
+	for _, tt := range tests {
+		tokens, err := parseSpeech(tt.markup)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseSpeech(%q) returned error %v", tt.markup, err)
+			continue
+		}
+		if len(tokens) != tt.wantTokens {
+			t.Errorf("parseSpeech(%q) returned %d tokens, want %d", tt.markup, len(tokens), tt.wantTokens)
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	tests := []struct {
+		name           string
+		wantMarkup     bool
+		wantErr        bool
+		wantNotAllowed bool // Whether the error is about unsupported SSML.
+	}{
+		{"Alice", false, false, false},
+		{"Bob <3", false, false, false},
+		{"x < y", false, false, false},
+		{"<3 <3 <3", false, false, false},
+		{`<phoneme alphabet="ipa" ph="ˈʃɪvɔːn">Siobhan</phoneme>`, true, false, false},
+		{`<speak>Alice<break time="1s"/></speak>`, true, false, false},
+		{"<speak>Alice", true, true, false},
+		{`<audio src="http://example.com/a.mp3"/>`, true, true, true},
+		{`Bob <audio src="http://example.com/a.mp3">`, true, true, true},
+		{`A<break time="2s"/>B<break time="2s"/>C`, true, true, true},
+		{"Alice Alice Alice Alice Alice Alice Alice Alice Alice Alice Alice Alice " +
+			"Alice Alice Alice Alice Alice", false, true, false},
+	}
+	for _, tt := range tests {
+		markup, err := checkName(tt.name)
+		if markup != tt.wantMarkup || (err != nil) != tt.wantErr {
+			t.Errorf("checkName(%q) = %t, %v; want %t, error %t", tt.name, markup, err, tt.wantMarkup, tt.wantErr)
+		}
+		if errors.Is(err, errSpeechNotAllowed) != tt.wantNotAllowed {
+			t.Errorf("checkName(%q) returned error %v", tt.name, err)
+		}
+	}
+}
+
+var testDict = map[string]Pronunciation{
+	"siobhan": {IPA: "ˈʃɪvɔːn", Alias: "Shivawn"},
+	"nguyen":  {Alias: "Win"},
+}
+
+func TestRenderSpeech(t *testing.T) {
+	tests := []struct {
+		markup string
+		ssml   bool
+		want   string
+	}{
+		{"Siobhan joined.", false, "Shivawn joined."},
+		{"Siobhan joined.", true, `<speak><phoneme alphabet="ipa" ph="ˈʃɪvɔːn">Siobhan</phoneme> joined.</speak>`},
+		{"NGUYEN left.", true, `<speak><sub alias="Win">NGUYEN</sub> left.</speak>`},
+		{"Tom &amp; Jerry", true, "<speak>Tom &amp; Jerry</speak>"},
+		// Elements saying how to pronounce something are left alone.
+		{`<sub alias="Shiv">Siobhan</sub> joined.`, true, `<speak><sub alias="Shiv">Siobhan</sub> joined.</speak>`},
+		{`<sub alias="Shiv">Siobhan</sub> joined.`, false, "Shiv joined."},
+		{`<emphasis>Siobhan</emphasis><break time="500ms"/>joined.`, false, "Shivawn joined."},
+		{`<emphasis><say-as interpret-as="characters">Nguyen</say-as></emphasis>`, false, "Nguyen"},
+		{`<speak><emphasis level="strong">Nguyen</emphasis></speak>`, true,
+			`<speak><emphasis level="strong"><sub alias="Win">Nguyen</sub></emphasis></speak>`},
+	}
+	for _, tt := range tests {
+		got, err := renderSpeech(tt.markup, testDict, tt.ssml)
+		if err != nil || got != tt.want {
+			t.Errorf("renderSpeech(%q, %t) = %q, %v; want %q", tt.markup, tt.ssml, got, err, tt.want)
+		}
+	}
+	if _, err := renderSpeech("<emphasis>Siobhan", testDict, true); err == nil {
+		t.Error("renderSpeech accepted unbalanced tags")
+	}
+}
+
+func TestApplyPronunciations(t *testing.T) {
+	tests := []struct {
+		text string
+		ssml bool
+		want string
+	}{
+		{"Siobhan and Nguyen", false, "Shivawn and Win"},
+		{"siobhan's", false, "siobhan's"},
+		{"Siobhans", false, "Siobhans"},
+		{"Nguyen, Nguyen!", false, "Win, Win!"},
+		{"Nguyen <3", true, `<sub alias="Win">Nguyen</sub> &lt;3`},
+		{"nobody", true, "nobody"},
+	}
+	for _, tt := range tests {
+		if got := applyPronunciations(tt.text, testDict, tt.ssml); got != tt.want {
+			t.Errorf("applyPronunciations(%q, %t) = %q, want %q", tt.text, tt.ssml, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+// Persistent per-guild settings, kept in an embedded bbolt database so that
+// every guild can be configured separately.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goproslowyo/trumpet/dca0"
+
+	"github.com/goproslowyo/discordgo"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The version of the guild settings. Bump it when the meaning of fields
+// changes, and migrate old settings in migrateGuild.
+//
+//  1. custom_names, ignore_list and voices are keyed by user ID instead of
+//     username.
+const guildSettingsVersion = 1
+
+// GuildSettings are the settings of a single guild.
+type GuildSettings struct {
+	Version int    `json:"version"`
+	Prefix  string `json:"prefix"`
+	// If not empty, only these voice channels are announced.
+	AnnounceChannels []string `json:"announce_channels"`
+	// These voice channels are never announced.
+	IgnoreChannels []string `json:"ignore_channels"`
+	// User ID to name. Usernames are still accepted as keys, but deprecated.
+	CustomNames map[string]string `json:"custom_names"`
+	// Word to pronunciation, applied to all announcements.
+	Pronunciations map[string]Pronunciation `json:"pronunciations"`
+	// Which name a user is announced by: the first of "custom", "nick",
+	// "display" and "username" that is set.
+	NameOrder []string `json:"name_order"`
+	// User and role IDs. Usernames are still accepted, but deprecated.
+	IgnoreList   []string     `json:"ignore_list"`
+	DefaultVoice VoiceProfile `json:"default_voice"`
+	// User ID to voice. Usernames are still accepted as keys, but deprecated.
+	Voices  map[string]VoiceProfile `json:"voices"`
+	Heralds HeraldSettings          `json:"heralds"`
+	// User ID to the sounds the user uploaded.
+	Sounds               map[string]UserSounds `json:"sounds"`
+	Templates            AnnounceTemplates     `json:"templates"`
+	Permissions          GuildPermissions      `json:"permissions"`
+	AnnounceWindowMs     int                   `json:"announce_window_ms"`
+	FlapWindowSecs       int                   `json:"flap_window_seconds"`
+	AnnounceCooldownSecs int                   `json:"announce_cooldown_seconds"`
+	// By how many dB music is lowered while an announcement plays over it.
+	MusicDuckDb float64 `json:"music_duck_db"`
+	// In percent, from 0 to maxVolume.
+	MusicVolume    int `json:"music_volume"`
+	AnnounceVolume int `json:"announce_volume"`
+}
+
+// The settings of guilds that haven't changed anything yet.
+func defaultGuildSettings() GuildSettings {
+	return GuildSettings{
+		Version:          guildSettingsVersion,
+		Prefix:           "!",
+		NameOrder:        defaultNameOrder,
+		DefaultVoice:     builtinVoice,
+		Templates:        defaultTemplates,
+		AnnounceWindowMs: int(defaultAnnounceWindow / time.Millisecond),
+		FlapWindowSecs:   5,
+		Heralds:          HeraldSettings{NoRepeat: 3},
+		MusicDuckDb:      12,
+		MusicVolume:      100,
+		AnnounceVolume:   100,
+	}
+}
+
+// Reports whether s looks like a Discord ID (snowflake) rather than a username.
+func isSnowflake(s string) bool {
+	if len(s) < 15 {
+		return false
+	}
+	_, err := strconv.ParseUint(s, 10, 64)
+	return err == nil
+}
+
+// Looks up the entry of the user in a map keyed by user ID. Keys that aren't
+// IDs are matched case insensitively against the username, which still works
+// for settings that couldn't be migrated, but breaks when the user renames
+// themselves.
+func lookupUser[V any](m map[string]V, setting string, user *discordgo.User) (V, bool) {
+	if v, ok := m[user.ID]; ok {
+		return v, true
+	}
+	for key, v := range m {
+		if !isSnowflake(key) && strings.EqualFold(key, user.Username) {
+			logger.Sugar().Warnf("Matched %s entry '%s' by username, which is deprecated. Replace it with the user ID %s.", setting, key, user.ID)
+			return v, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Returns the custom name of the user, if any.
+func (gs *GuildSettings) CustomName(user *discordgo.User) (string, bool) {
+	return lookupUser(gs.CustomNames, "custom_names", user)
+}
+
+// Returns the voice profile of the user.
+func (gs *GuildSettings) VoiceFor(user *discordgo.User) VoiceProfile {
+	def := gs.DefaultVoice.withDefaults(builtinVoice)
+	if v, ok := lookupUser(gs.Voices, "voices", user); ok {
+		return v.withDefaults(def)
+	}
+	return def
+}
+
+// Reports whether the member, or one of their roles, is on the ignore list.
+func (gs *GuildSettings) IsIgnored(member *discordgo.Member) bool {
+	for _, ignored := range gs.IgnoreList {
+		if ignored == member.User.ID || slices.Contains(member.Roles, ignored) {
+			return true
+		}
+		if !isSnowflake(ignored) && ignored == member.User.Username {
+			logger.Sugar().Warnf("Matched ignore_list entry '%s' by username, which is deprecated. Replace it with the user ID %s.", ignored, member.User.ID)
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether events in the voice channel are announced.
+func (gs *GuildSettings) AnnouncesChannel(channelID string) bool {
+	if slices.Contains(gs.IgnoreChannels, channelID) {
+		return false
+	}
+	return len(gs.AnnounceChannels) == 0 || slices.Contains(gs.AnnounceChannels, channelID)
+}
+
+// //////////////////////////////
+// Database.
+// //////////////////////////////
+var (
+	bucketMeta   = []byte("meta")
+	bucketGuilds = []byte("guilds") // Guild ID to JSON encoded GuildSettings.
+	// Loudness target and media to JSON encoded dca0.LoudnessMeasurement.
+	bucketLoudness = []byte("loudness")
+
+	keySchemaVersion  = []byte("schema_version")
+	keyLegacySettings = []byte("legacy_settings")
+)
+
+type Store struct {
+	db *bolt.DB
+}
+
+// A migration brings the database from one schema version to the next. The
+// schema version is the number of migrations applied.
+type migration func(tx *bolt.Tx) error
+
+var migrations = []migration{
+	// 1: Create the guild bucket.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketGuilds)
+		return err
+	},
+	// 2: Import the settings that config.json used to share between all
+	// guilds.
+	migrateLegacyConfig,
+	// 3: Create the bucket of loudness measurements.
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketLoudness)
+		return err
+	},
+}
+
+// Opens the database, creating it if needed, and brings it up to date.
+func OpenStore(path string) (*Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("unable to open database: %w", err)
+	}
+	st := &Store{db: db}
+	if err := st.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+func (st *Store) Close() error {
+	return st.db.Close()
+}
+
+// Runs all pending migrations in a single transaction, so that a failing one
+// leaves the database untouched.
+func (st *Store) migrate() error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(bucketMeta)
+		if err != nil {
+			return err
+		}
+		version := 0
+		if v := meta.Get(keySchemaVersion); v != nil {
+			if version, err = strconv.Atoi(string(v)); err != nil {
+				return fmt.Errorf("invalid schema version '%s'", v)
+			}
+		}
+		if version > len(migrations) {
+			return fmt.Errorf("database schema version %d is newer than this binary supports (%d)", version, len(migrations))
+		}
+		for ; version < len(migrations); version++ {
+			logger.Sugar().Infof("Migrating database to schema version %d.", version+1)
+			if err := migrations[version](tx); err != nil {
+				return fmt.Errorf("database migration %d failed: %w", version+1, err)
+			}
+		}
+		return meta.Put(keySchemaVersion, []byte(strconv.Itoa(version)))
+	})
+}
+
+// Returns the settings of the guild, or the defaults if it has none yet.
+func (st *Store) Guild(guildID string) (GuildSettings, error) {
+	gs := defaultGuildSettings()
+	err := st.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketGuilds).Get([]byte(guildID))
+		if data == nil {
+			return nil
+		}
+		return json.Unmarshal(data, &gs)
+	})
+	return gs, err
+}
+
+// Applies update to the settings of the guild and saves them, all within one
+// transaction.
+func (st *Store) UpdateGuild(guildID string, update func(gs *GuildSettings) error) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketGuilds)
+		gs := defaultGuildSettings()
+		if data := b.Get([]byte(guildID)); data != nil {
+			if err := json.Unmarshal(data, &gs); err != nil {
+				return err
+			}
+		}
+		if err := update(&gs); err != nil {
+			return err
+		}
+		data, err := json.Marshal(&gs)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(guildID), data)
+	})
+}
+
+// Returns the settings of the guild. Errors are logged and result in the
+// default settings, so that a broken database doesn't stop announcements.
+func GetGuildSettings(guildID string) GuildSettings {
+	gs, err := store.Guild(guildID)
+	if err != nil {
+		logger.Sugar().Errorf("Error reading settings of guild %s: %s", guildID, err)
+		return defaultGuildSettings()
+	}
+	return gs
+}
+
+// Returns the cached loudness measurement of the media, if any.
+func (st *Store) Loudness(key string) (*dca0.LoudnessMeasurement, bool) {
+	var m *dca0.LoudnessMeasurement
+	err := st.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucketLoudness).Get([]byte(key))
+		if data == nil {
+			return nil
+		}
+		m = &dca0.LoudnessMeasurement{}
+		return json.Unmarshal(data, m)
+	})
+	if err != nil {
+		logger.Sugar().Errorf("Error reading loudness of %s: %s", key, err)
+		return nil, false
+	}
+	return m, m != nil
+}
+
+func (st *Store) SetLoudness(key string, m *dca0.LoudnessMeasurement) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return st.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketLoudness).Put([]byte(key), data)
+	})
+}
+
+// //////////////////////////////
+// Migration from config.json.
+// //////////////////////////////
+// The guild settings config.json had before they moved into the database.
+type legacyConfig struct {
+	AnnounceCooldownSecs int                         `json:"announce_cooldown_seconds"`
+	AnnounceWindowMs     int                         `json:"announce_window_ms"`
+	CustomNames          map[string]string           `json:"custom_names"`
+	DefaultVoice         VoiceProfile                `json:"default_voice"`
+	FlapWindowSecs       int                         `json:"flap_window_seconds"`
+	IgnoreList           []string                    `json:"ignore_list"`
+	Permissions          map[string]GuildPermissions `json:"permissions"`
+	Prefix               string                      `json:"prefix"`
+	Templates            AnnounceTemplates           `json:"templates"`
+	Voices               map[string]VoiceProfile     `json:"voices"`
+}
+
+// Stores the guild settings found in config.json. We don't know which guilds
+// they were meant for until we are connected, so AdoptLegacySettings hands
+// them out later.
+func migrateLegacyConfig(tx *bolt.Tx) error {
+	data, err := os.ReadFile(configFile)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	return importLegacyConfig(tx, data)
+}
+
+// Stores the guild settings of the config.json data, if it has any.
+func importLegacyConfig(tx *bolt.Tx, data []byte) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	var legacyFields []string
+	for _, key := range []string{"announce_cooldown_seconds", "announce_window_ms", "custom_names", "default_voice", "flap_window_seconds", "ignore_list", "permissions", "prefix", "templates", "voices"} {
+		if _, ok := fields[key]; ok {
+			legacyFields = append(legacyFields, key)
+		}
+	}
+	if len(legacyFields) == 0 {
+		return nil
+	}
+	var legacy legacyConfig
+	if err := json.Unmarshal(data, &legacy); err != nil {
+		return err
+	}
+	logger.Sugar().Infof("Importing guild settings from %s: %s. They are no longer read from there.", configFile, strings.Join(legacyFields, ", "))
+	data, err := json.Marshal(&legacy)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(bucketMeta).Put(keyLegacySettings, data)
+}
+
+// Gives the settings imported from config.json to all guilds that don't have
+// their own settings yet. This is called once the bot knows which guilds it is
+// in, and only the guilds it was in when it was upgraded get them; guilds
+// added later start with the defaults.
+func (st *Store) AdoptLegacySettings(guildIDs []string) error {
+	return st.db.Update(func(tx *bolt.Tx) error {
+		meta := tx.Bucket(bucketMeta)
+		data := meta.Get(keyLegacySettings)
+		if data == nil {
+			return nil
+		}
+		var legacy legacyConfig
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+
+		guilds := tx.Bucket(bucketGuilds)
+		for _, guildID := range guildIDs {
+			if guilds.Get([]byte(guildID)) != nil {
+				continue
+			}
+			gs := defaultGuildSettings()
+			// The legacy settings are keyed by username.
+			gs.Version = 0
+			if legacy.Prefix != "" {
+				gs.Prefix = legacy.Prefix
+			}
+			gs.CustomNames = legacy.CustomNames
+			gs.IgnoreList = legacy.IgnoreList
+			gs.DefaultVoice = legacy.DefaultVoice
+			gs.Voices = legacy.Voices
+			if len(legacy.Templates.Join)+len(legacy.Templates.Leave)+len(legacy.Templates.Move) > 0 {
+				gs.Templates = legacy.Templates
+			}
+			gs.Permissions = legacy.Permissions[guildID]
+			if legacy.AnnounceWindowMs > 0 {
+				gs.AnnounceWindowMs = legacy.AnnounceWindowMs
+			}
+			// Missing in most configs, which mustn't turn off the
+			// flap suppression.
+			if legacy.FlapWindowSecs > 0 {
+				gs.FlapWindowSecs = legacy.FlapWindowSecs
+			}
+			gs.AnnounceCooldownSecs = legacy.AnnounceCooldownSecs
+
+			data, err := json.Marshal(&gs)
+			if err != nil {
+				return err
+			}
+			if err := guilds.Put([]byte(guildID), data); err != nil {
+				return err
+			}
+			logger.Sugar().Infof("Imported settings from %s for guild %s.", configFile, guildID)
+		}
+		return meta.Delete(keyLegacySettings)
+	})
+}
+
+// //////////////////////////////
+// Migration of guild settings.
+// //////////////////////////////
+// Brings the settings of the guilds up to the current version. Migrations that
+// need information from Discord can't run as database migrations; they run
+// here, once we are connected. A guild whose migration fails is retried on the
+// next start.
+func MigrateGuilds(s *discordgo.Session, guildIDs []string) {
+	for _, guildID := range guildIDs {
+		gs, err := store.Guild(guildID)
+		if err != nil {
+			logger.Sugar().Errorf("Error reading settings of guild %s: %s", guildID, err)
+			continue
+		}
+		if gs.Version >= guildSettingsVersion {
+			continue
+		}
+		if err := migrateGuild(s, guildID); err != nil {
+			logger.Sugar().Errorf("Error migrating settings of guild %s: %s", guildID, err)
+		}
+	}
+}
+
+func migrateGuild(s *discordgo.Session, guildID string) error {
+	// Resolving usernames needs the member list, which we fetch outside of
+	// the transaction.
+	usernames, err := guildUsernames(s, guildID)
+	if err != nil {
+		return fmt.Errorf("unable to get the member list: %w", err)
+	}
+	return store.UpdateGuild(guildID, func(gs *GuildSettings) error {
+		if gs.Version < 1 {
+			var unresolved []string
+			resolve := func(name string) string {
+				if isSnowflake(name) {
+					return name
+				}
+				if id, ok := usernames[strings.ToLower(name)]; ok {
+					return id
+				}
+				unresolved = append(unresolved, name)
+				return name
+			}
+			gs.CustomNames = rekeyByID(gs.CustomNames, resolve)
+			gs.Voices = rekeyByID(gs.Voices, resolve)
+			for i, name := range gs.IgnoreList {
+				gs.IgnoreList[i] = resolve(name)
+			}
+			if len(unresolved) > 0 {
+				logger.Sugar().Warnf("Guild %s: couldn't find the members %s; they are still matched by username, which is deprecated.", guildID, strings.Join(unresolved, ", "))
+			}
+		}
+		gs.Version = guildSettingsVersion
+		logger.Sugar().Infof("Migrated settings of guild %s to version %d.", guildID, gs.Version)
+		return nil
+	})
+}
+
+// Replaces the username keys of m with user IDs, as returned by resolve.
+func rekeyByID[V any](m map[string]V, resolve func(name string) string) map[string]V {
+	if m == nil {
+		return nil
+	}
+	res := make(map[string]V, len(m))
+	for k, v := range m {
+		res[resolve(k)] = v
+	}
+	return res
+}
+
+// Returns a map of the lowercase usernames of all members of the guild to
+// their user IDs.
+func guildUsernames(s *discordgo.Session, guildID string) (map[string]string, error) {
+	members, err := guildMembers(s, guildID)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make(map[string]string)
+	for _, m := range members {
+		usernames[strings.ToLower(m.User.Username)] = m.User.ID
+	}
+	return usernames, nil
+}
+
+// Fetches all members of the guild. This needs the server members intent.
+func guildMembers(s *discordgo.Session, guildID string) ([]*discordgo.Member, error) {
+	var all []*discordgo.Member
+	after := ""
+	for {
+		members, err := s.GuildMembers(guildID, after, 1000)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, members...)
+		if len(members) < 1000 {
+			return all, nil
+		}
+		after = members[len(members)-1].User.ID
+	}
+}
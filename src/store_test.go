@@ -0,0 +1,112 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func openTestStore(t *testing.T) *Store {
+	t.Helper()
+	st, err := OpenStore(filepath.Join(t.TempDir(), "trumpet.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+// Imports config.json data as if it was found when the database was created.
+func importTestConfig(t *testing.T, st *Store, config string) {
+	t.Helper()
+	err := st.db.Update(func(tx *bolt.Tx) error {
+		return importLegacyConfig(tx, []byte(config))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAdoptLegacySettings(t *testing.T) {
+	st := openTestStore(t)
+	importTestConfig(t, st, `{
+		"token": "abc",
+		"prefix": "?",
+		"custom_names": {"alice": "Alicia"},
+		"announce_cooldown_seconds": 30,
+		"permissions": {"1": {"dj_roles": ["2"]}}
+	}`)
+	if err := st.UpdateGuild("3", func(gs *GuildSettings) error {
+		gs.Prefix = "$"
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.AdoptLegacySettings([]string{"1", "3"}); err != nil {
+		t.Fatal(err)
+	}
+
+	gs, err := st.Guild("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultGuildSettings()
+	if gs.Prefix != "?" || gs.CustomNames["alice"] != "Alicia" || gs.AnnounceCooldownSecs != 30 {
+		t.Errorf("settings weren't imported: %+v", gs)
+	}
+	if len(gs.Permissions.DJRoles) != 1 || gs.Permissions.DJRoles[0] != "2" {
+		t.Errorf("permissions of the guild weren't imported: %+v", gs.Permissions)
+	}
+	// Settings missing in config.json keep their defaults.
+	if gs.FlapWindowSecs != def.FlapWindowSecs || gs.AnnounceWindowMs != def.AnnounceWindowMs {
+		t.Errorf("flap window %d and announce window %d, want the defaults %d and %d",
+			gs.FlapWindowSecs, gs.AnnounceWindowMs, def.FlapWindowSecs, def.AnnounceWindowMs)
+	}
+	// The legacy settings are keyed by username until MigrateGuilds runs.
+	if gs.Version != 0 {
+		t.Errorf("imported settings have version %d", gs.Version)
+	}
+
+	// Guilds with their own settings keep them.
+	if gs, err := st.Guild("3"); err != nil || gs.Prefix != "$" || gs.CustomNames != nil {
+		t.Errorf("settings of guild 3 were overwritten: %+v, %v", gs, err)
+	}
+
+	// The settings are only handed out once.
+	if err := st.AdoptLegacySettings([]string{"4"}); err != nil {
+		t.Fatal(err)
+	}
+	if gs, err := st.Guild("4"); err != nil || gs.Prefix != def.Prefix {
+		t.Errorf("guild 4 got the legacy settings: %+v, %v", gs, err)
+	}
+}
+
+func TestAdoptLegacySettingsFlapWindow(t *testing.T) {
+	st := openTestStore(t)
+	importTestConfig(t, st, `{"flap_window_seconds": 10, "announce_window_ms": 2000}`)
+	if err := st.AdoptLegacySettings([]string{"1"}); err != nil {
+		t.Fatal(err)
+	}
+	gs, err := st.Guild("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gs.FlapWindowSecs != 10 || gs.AnnounceWindowMs != 2000 {
+		t.Errorf("flap window %d and announce window %d, want 10 and 2000", gs.FlapWindowSecs, gs.AnnounceWindowMs)
+	}
+}
+
+func TestImportLegacyConfigWithoutGuildSettings(t *testing.T) {
+	st := openTestStore(t)
+	importTestConfig(t, st, `{"token": "abc", "ffmpeg_path": "ffmpeg"}`)
+	err := st.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(bucketMeta).Get(keyLegacySettings) != nil {
+			t.Error("settings were imported from a config without any")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,140 @@
+// Renders the text of voice channel announcements from the configurable
+// templates.
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+type AnnounceEvent int
+
+const (
+	announceJoin AnnounceEvent = iota
+	announceLeave
+	announceMove
+)
+
+func (e AnnounceEvent) String() string {
+	switch e {
+	case announceJoin:
+		return "join"
+	case announceLeave:
+		return "leave"
+	case announceMove:
+		return "move"
+	}
+	return "unknown"
+}
+
+// AnnounceTemplates holds text/template strings for each event. If an event has
+// more than one template, a random one is picked every time.
+type AnnounceTemplates struct {
+	Join  []string `json:"join"`
+	Leave []string `json:"leave"`
+	Move  []string `json:"move"`
+}
+
+var defaultTemplates = AnnounceTemplates{
+	Join:  []string{"{{.Name}} joined."},
+	Leave: []string{"{{.Name}} left."},
+	Move:  []string{"{{.Name}} moved to {{.Channel}}."},
+}
+
+// AnnounceData is what the templates have access to. When several users are
+// announced at once, the name fields hold all of their names joined like
+// "A, B and C".
+type AnnounceData struct {
+	Name        string   // The name that is announced, e.g. the custom name.
+	Names       []string // The individual names if several users are announced.
+	Count       int      // Number of users announced, 1 if not coalesced.
+	Username    string
+	Nickname    string // Guild nickname, may be empty.
+	DisplayName string // Global display name, may be empty.
+	Channel     string // The voice channel the user is in after the event.
+	FromChannel string // The voice channel the user was in before the event.
+	TimeOfDay   string // "morning", "afternoon", "evening" or "night".
+	Time        string // Local time, e.g. "21:05".
+	MemberCount int    // Number of users in Channel after the event.
+}
+
+// Fills in the time related fields of d.
+func (d *AnnounceData) setTime(t time.Time) {
+	switch h := t.Hour(); {
+	case h >= 5 && h < 12:
+		d.TimeOfDay = "morning"
+	case h >= 12 && h < 17:
+		d.TimeOfDay = "afternoon"
+	case h >= 17 && h < 22:
+		d.TimeOfDay = "evening"
+	default:
+		d.TimeOfDay = "night"
+	}
+	d.Time = t.Format("15:04")
+}
+
+// Returns the templates for the event, falling back to the defaults if the
+// config doesn't have any.
+func (t *AnnounceTemplates) forEvent(e AnnounceEvent) []string {
+	var tmpls, defs []string
+	switch e {
+	case announceJoin:
+		tmpls, defs = t.Join, defaultTemplates.Join
+	case announceLeave:
+		tmpls, defs = t.Leave, defaultTemplates.Leave
+	case announceMove:
+		tmpls, defs = t.Move, defaultTemplates.Move
+	}
+	if len(tmpls) == 0 {
+		return defs
+	}
+	return tmpls
+}
+
+// RenderAnnouncement picks one of the templates for the event and executes it
+// with data.
+func RenderAnnouncement(tmpls *AnnounceTemplates, e AnnounceEvent, data AnnounceData) (string, error) {
+	choices := tmpls.forEvent(e)
+	if len(choices) == 0 {
+		return "", errors.New("no templates for event " + e.String())
+	}
+	return executeTemplate(e, choices[rand.Intn(len(choices))], data)
+}
+
+// The fields of AnnounceData that differ from event to event, even for the
+// same member.
+var eventFields = regexp.MustCompile(`\.(Channel|FromChannel|TimeOfDay|Time|MemberCount)\b`)
+
+// Renders every template of the event that only depends on the member, for
+// generating clips ahead of time. The others wouldn't render the same text
+// when the event happens.
+func RenderAllAnnouncements(tmpls *AnnounceTemplates, e AnnounceEvent, data AnnounceData) ([]string, error) {
+	var texts []string
+	for _, src := range tmpls.forEvent(e) {
+		if eventFields.MatchString(src) {
+			continue
+		}
+		text, err := executeTemplate(e, src, data)
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, text)
+	}
+	return texts, nil
+}
+
+func executeTemplate(e AnnounceEvent, src string, data AnnounceData) (string, error) {
+	tmpl, err := template.New(e.String()).Parse(src)
+	if err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	if err := tmpl.Execute(&text, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(text.String()), nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestRenderAllAnnouncementsSkipsEventFields(t *testing.T) {
+	tmpls := AnnounceTemplates{Join: []string{
+		"{{.Name}} joined.",
+		"{{.Name}} joined {{.Channel}}.",
+		"{{.Name}} came from {{.FromChannel}}.",
+		"Good {{.TimeOfDay}}, {{.Name}}.",
+		"{{.Name}} joined at {{.Time}}.",
+		"{{.Name}} is number {{.MemberCount}}.",
+		"{{with .Channel}}{{.}}{{end}}",
+		"Welcome, {{.DisplayName}} ({{.Username}}).",
+	}}
+	data := AnnounceData{Name: "Alice", Username: "alice", DisplayName: "Ally", Channel: "General"}
+	texts, err := RenderAllAnnouncements(&tmpls, announceJoin, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"Alice joined.", "Welcome, Ally (alice)."}
+	if !slices.Equal(texts, want) {
+		t.Errorf("rendered %q, want %q", texts, want)
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	texttospeech "cloud.google.com/go/texttospeech/apiv1"
+	"google.golang.org/api/option"
+
+	texttospeechpb "cloud.google.com/go/texttospeech/apiv1/texttospeechpb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Values accepted by the tts_provider config field.
+const (
+	ttsProviderGoogle = "google"
+	ttsProviderEspeak = "espeak-ng"
+	ttsProviderPiper  = "piper"
+)
+
+// TTSProvider turns text into speech. The returned audio is always Ogg/Opus,
+// which is what GetAudioFile stores and PlayAudioFile plays back.
+// Providers ignore the parts of the voice profile they don't support.
+type TTSProvider interface {
+	// text is plain text, or an SSML document if the provider supports SSML.
+	Synthesize(ctx context.Context, text string, voice VoiceProfile) ([]byte, error)
+	SupportsSSML() bool
+	// Releases the resources of the provider.
+	Close() error
+}
+
+// How long a single synthesis request may take.
+const ttsRequestTimeout = 10 * time.Second
+
+// Creates the TTS provider selected by the tts_provider config field. An empty
+// field selects Google Cloud TTS to stay compatible with older configs.
+func NewTTSProvider(conf *Config) (TTSProvider, error) {
+	switch conf.TTSProvider {
+	case "", ttsProviderGoogle:
+		return NewGoogleTTS(conf.GoogleServiceAccountCredentials)
+	case ttsProviderEspeak, ttsProviderPiper:
+		path := conf.LocalTTSPath
+		if path == "" {
+			path = conf.TTSProvider
+		}
+		if conf.TTSProvider == ttsProviderPiper && conf.PiperModel == "" {
+			return nil, errors.New("tts provider piper requires piper_model to be set")
+		}
+		return &LocalTTS{
+			Engine:     conf.TTSProvider,
+			Path:       path,
+			Model:      conf.PiperModel,
+			FfmpegPath: conf.FfmpegPath,
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown tts provider '%s'", conf.TTSProvider)
+	}
+}
+
+// //////////////////////////////
+// Google Cloud Text-to-Speech.
+// //////////////////////////////
+// GoogleTTS keeps one client for the lifetime of the bot. Failed requests are
+// retried with exponential backoff if the error is likely to be temporary.
+type GoogleTTS struct {
+	client *texttospeech.Client
+}
+
+// Attempts per synthesis, and the delay before the first retry, which doubles
+// with every further retry.
+const (
+	googleAttempts = 3
+	googleBackoff  = 500 * time.Millisecond
+)
+
+// Creates the client, reading the service account JSON file.
+func NewGoogleTTS(credentialsFile string) (*GoogleTTS, error) {
+	b, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open google service account file: %w", err)
+	}
+	c, err := texttospeech.NewClient(context.Background(), option.WithCredentialsJSON(b))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create client: %w", err)
+	}
+	return &GoogleTTS{client: c}, nil
+}
+
+func (t *GoogleTTS) Close() error {
+	return t.client.Close()
+}
+
+func (t *GoogleTTS) SupportsSSML() bool {
+	return true
+}
+
+func (t *GoogleTTS) Synthesize(ctx context.Context, text string, voice VoiceProfile) ([]byte, error) {
+	input := &texttospeechpb.SynthesisInput{
+		InputSource: &texttospeechpb.SynthesisInput_Text{Text: text},
+	}
+	if strings.HasPrefix(text, "<speak") {
+		input.InputSource = &texttospeechpb.SynthesisInput_Ssml{Ssml: text}
+	}
+	req := &texttospeechpb.SynthesizeSpeechRequest{
+		Input: input,
+		Voice: &texttospeechpb.VoiceSelectionParams{
+			LanguageCode: voice.LanguageCode,
+			Name:         voice.Name,
+		},
+		AudioConfig: &texttospeechpb.AudioConfig{
+			AudioEncoding: texttospeechpb.AudioEncoding_OGG_OPUS,
+			SpeakingRate:  voice.SpeakingRate,
+			Pitch:         voice.Pitch,
+		},
+	}
+
+	backoff := googleBackoff
+	for attempt := 1; ; attempt++ {
+		audio, err := t.synthesizeOnce(ctx, req)
+		if err == nil {
+			return audio, nil
+		}
+		if attempt == googleAttempts || !isTransient(err) {
+			return nil, err
+		}
+		logger.Sugar().Warnf("Google TTS request failed (attempt %d of %d), retrying in %s: %s", attempt, googleAttempts, backoff, err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		backoff *= 2
+	}
+}
+
+func (t *GoogleTTS) synthesizeOnce(ctx context.Context, req *texttospeechpb.SynthesizeSpeechRequest) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ttsRequestTimeout)
+	defer cancel()
+	resp, err := t.client.SynthesizeSpeech(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	if resp == nil || len(resp.AudioContent) == 0 {
+		return nil, errors.New("google tts returned no audio")
+	}
+	return resp.AudioContent, nil
+}
+
+// Reports whether retrying the request may succeed.
+func isTransient(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Internal, codes.Aborted:
+		return true
+	}
+	return errors.Is(err, context.DeadlineExceeded)
+}
+
+// //////////////////////////////
+// Local engines (espeak-ng, piper).
+// //////////////////////////////
+// LocalTTS shells out to an offline TTS engine and transcodes its WAV output
+// to Ogg/Opus using ffmpeg. No network access or credentials are needed.
+type LocalTTS struct {
+	Engine     string // ttsProviderEspeak or ttsProviderPiper.
+	Path       string // Path to the engine binary.
+	Model      string // Piper voice model (.onnx). Unused by espeak-ng.
+	FfmpegPath string
+}
+
+func (t *LocalTTS) Synthesize(ctx context.Context, text string, voice VoiceProfile) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, ttsRequestTimeout)
+	defer cancel()
+	wav, err := t.synthesizeWav(ctx, text, voice)
+	if err != nil {
+		return nil, err
+	}
+	return encodeOggOpus(ctx, t.FfmpegPath, wav)
+}
+
+func (t *LocalTTS) Close() error {
+	return nil
+}
+
+// espeak-ng understands some SSML, but not the phonemes the pronunciation
+// dictionary uses, and piper none at all.
+func (t *LocalTTS) SupportsSSML() bool {
+	return false
+}
+
+// The text is always passed through stdin so that names starting with a dash
+// can't be mistaken for command line flags.
+func (t *LocalTTS) synthesizeWav(ctx context.Context, text string, voice VoiceProfile) ([]byte, error) {
+	switch t.Engine {
+	case ttsProviderEspeak:
+		// espeak-ng's voices are named after lowercase language codes
+		// ("en-us", "de"), Google's voice names mean nothing to it.
+		v := strings.ToLower(voice.LanguageCode)
+		if voice.Name != "" && !strings.Contains(voice.Name, "-") {
+			v = voice.Name
+		}
+		args := []string{"--stdin", "--stdout"}
+		if v != "" {
+			args = append(args, "-v", v)
+		}
+		if voice.SpeakingRate > 0 {
+			// 175 words per minute is espeak-ng's normal speed.
+			args = append(args, "-s", strconv.Itoa(int(175*voice.SpeakingRate)))
+		}
+		// espeak-ng's pitch goes from 0 to 99 with 50 as the default, which
+		// roughly maps to the -20 to 20 semitones used by voice profiles.
+		pitch := int(50 + 2.5*voice.Pitch)
+		pitch = max(0, min(99, pitch))
+		args = append(args, "-p", strconv.Itoa(pitch))
+		cmd := exec.CommandContext(ctx, t.Path, args...)
+		return runWithStdin(cmd, text)
+	case ttsProviderPiper:
+		// Piper can only write WAV headers to a file, not to stdout.
+		f, err := os.CreateTemp("", "trumpet-piper-*.wav")
+		if err != nil {
+			return nil, err
+		}
+		f.Close()
+		defer os.Remove(f.Name())
+
+		model := t.Model
+		if strings.HasSuffix(voice.Name, ".onnx") {
+			m, err := t.piperModel(voice.Name)
+			if err != nil {
+				return nil, err
+			}
+			model = m
+		}
+		args := []string{"--model", model, "--output_file", f.Name()}
+		if voice.SpeakingRate > 0 {
+			args = append(args, "--length_scale", strconv.FormatFloat(1/voice.SpeakingRate, 'f', 3, 64))
+		}
+		cmd := exec.CommandContext(ctx, t.Path, args...)
+		if _, err := runWithStdin(cmd, text); err != nil {
+			return nil, err
+		}
+		return os.ReadFile(f.Name())
+	default:
+		return nil, fmt.Errorf("unknown local tts engine '%s'", t.Engine)
+	}
+}
+
+// Piper voices are separate models, so a voice name is a model file. Voice
+// names are set by users, so they can only select models next to piper_model.
+func (t *LocalTTS) piperModel(name string) (string, error) {
+	if name != filepath.Base(name) || strings.ContainsRune(name, '\\') {
+		return "", fmt.Errorf("invalid piper voice '%s'", name)
+	}
+	return filepath.Join(filepath.Dir(t.Model), name), nil
+}
+
+// Transcodes audio of any format supported by ffmpeg to Ogg/Opus.
+func encodeOggOpus(ctx context.Context, ffmpegPath string, audio []byte) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, ffmpegPath,
+		"-i", "pipe:0",
+		"-c:a", "libopus",
+		"-b:a", "64k",
+		"-f", "ogg",
+		"pipe:1")
+	cmd.Stdin = bytes.NewReader(audio)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("ffmpeg: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// Runs cmd with input written to its stdin and returns its stdout.
+func runWithStdin(cmd *exec.Cmd, input string) ([]byte, error) {
+	cmd.Stdin = strings.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %w: %s", cmd.Path, err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,212 @@
+// Per-guild voice connections and audio clip playback.
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goproslowyo/trumpet/dca0"
+
+	"github.com/goproslowyo/discordgo"
+	"go.uber.org/zap"
+)
+
+// The bot stops "speaking" after this long without audio.
+const speakingTimeout = 250 * time.Millisecond
+
+// A number of audio files that are played back to back in a voice channel.
+type playJob struct {
+	channelID string
+	files     []string
+}
+
+// GuildPlayer plays audio clips in one guild. Clips are played one after the
+// other within the guild, while separate guilds play concurrently. Clips and
+// music both go through the guild's mixer, which plays the clips on top of
+// the music.
+// The player owns the guild's voice connection. While music is playing, the
+// bot stays in the music's channel and clips for other channels are dropped.
+type GuildPlayer struct {
+	s       *discordgo.Session
+	guildID string
+	jobs    chan playJob
+	mixer   *dca0.Mixer
+	errCh   chan error // Mixer errors.
+
+	mVoice sync.Mutex
+	// The channel music is playing in, "" if none is.
+	musicChannelID string
+}
+
+// Returns the player of the guild, starting it if it doesn't exist yet.
+func GetGuildPlayer(s *discordgo.Session, guildID string) *GuildPlayer {
+	mPlayers.Lock()
+	defer mPlayers.Unlock()
+	p, ok := players[guildID]
+	if !ok {
+		p = &GuildPlayer{
+			s:       s,
+			guildID: guildID,
+			// Buffered so that event handlers don't have to wait for
+			// clips to finish playing.
+			jobs:  make(chan playJob, 32),
+			errCh: make(chan error),
+		}
+		gs := GetGuildSettings(guildID)
+		var err error
+		p.mixer, err = dca0.NewMixer(dca0.GetDefaultOptions(cfg().FfmpegPath), gs.MusicDuckDb, p.errCh)
+		if err != nil {
+			// Only happens if opus doesn't support our constant options.
+			logger.Fatal("Failed to create the audio mixer", zap.Error(err))
+		}
+		players[guildID] = p
+		go p.run()
+		go p.send()
+	}
+	return p
+}
+
+// Queues the files for playback in the voice channel. Returns immediately.
+func (p *GuildPlayer) Play(channelID string, files ...string) {
+	select {
+	case p.jobs <- playJob{channelID: channelID, files: files}:
+	default:
+		logger.Warn("Playback queue is full, dropping clips",
+			zap.String("guild", p.guildID),
+			zap.Strings("files", files),
+		)
+	}
+}
+
+// Joins the channel to play music in it and keeps the bot there until
+// StopMusic is called.
+func (p *GuildPlayer) StartMusic(channelID string) error {
+	p.mVoice.Lock()
+	defer p.mVoice.Unlock()
+	if _, err := JoinVoiceChannel(p.s, p.guildID, channelID); err != nil {
+		return err
+	}
+	p.musicChannelID = channelID
+	return nil
+}
+
+// Lets clips move the bot to other channels again. The bot stays connected.
+func (p *GuildPlayer) StopMusic() {
+	p.mVoice.Lock()
+	p.musicChannelID = ""
+	p.mVoice.Unlock()
+}
+
+// Returns the channel music is playing in, if any.
+func (p *GuildPlayer) MusicChannel() (string, bool) {
+	p.mVoice.Lock()
+	defer p.mVoice.Unlock()
+	return p.musicChannelID, p.musicChannelID != ""
+}
+
+// Joins the channel of the job, unless music is playing elsewhere.
+func (p *GuildPlayer) joinFor(job playJob) bool {
+	p.mVoice.Lock()
+	defer p.mVoice.Unlock()
+	if p.musicChannelID != "" && p.musicChannelID != job.channelID {
+		logger.Debug("Not playing clips in another channel while music is playing",
+			zap.String("guild", p.guildID),
+			zap.String("channel", job.channelID),
+			zap.Strings("files", job.files),
+		)
+		return false
+	}
+	if _, err := JoinVoiceChannel(p.s, p.guildID, job.channelID); err != nil {
+		logger.Sugar().Errorf("Error joining voice channel %s: %s", job.channelID, err)
+		return false
+	}
+	return true
+}
+
+func (p *GuildPlayer) run() {
+	for job := range p.jobs {
+		if !p.joinFor(job) {
+			continue
+		}
+		// The setting may have changed since the last announcement.
+		gs := GetGuildSettings(p.guildID)
+		p.mixer.SetDuck(gs.MusicDuckDb)
+		p.mixer.SetOverlayVolume(float64(gs.AnnounceVolume) / 100)
+		for _, f := range job.files {
+			PlayAudioFile(p.mixer, f, make(<-chan bool))
+		}
+	}
+}
+
+// Sends the mixed audio to the guild's current voice connection, which may
+// change while the mixer is running.
+func (p *GuildPlayer) send() {
+	var vc *discordgo.VoiceConnection
+	speaking := false
+	idle := time.NewTimer(speakingTimeout)
+	for {
+		var frame []byte
+		select {
+		case frame = <-p.mixer.Output():
+		case err := <-p.errCh:
+			logger.Warn("Audio mixer error", zap.String("guild", p.guildID), zap.Error(err))
+			continue
+		case <-idle.C:
+			if speaking {
+				vc.Speaking(false)
+				speaking = false
+			}
+			continue
+		}
+		if !idle.Stop() {
+			select {
+			case <-idle.C:
+			default:
+			}
+		}
+		idle.Reset(speakingTimeout)
+
+		p.s.RLock()
+		current := p.s.VoiceConnections[p.guildID]
+		p.s.RUnlock()
+		if current != vc {
+			vc = current
+			speaking = false
+		}
+		if vc == nil {
+			// Keep the pace of one frame per 20ms, the audio is just lost.
+			time.Sleep(20 * time.Millisecond)
+			continue
+		}
+		if !speaking {
+			if err := vc.Speaking(true); err != nil {
+				logger.Sugar().Errorf("Couldn't set speaking: %s", err)
+			}
+			speaking = true
+		}
+		select {
+		case vc.OpusSend <- frame:
+		case <-time.After(time.Second):
+			// The connection was closed.
+			logger.Warn("Voice connection isn't accepting audio, dropping it", zap.String("guild", p.guildID))
+		}
+	}
+}
+
+// JoinVoiceChannel returns the voice connection of the guild, joining or moving
+// to the channel first if needed. There is only one voice connection per
+// guild, so joining a channel leaves the previous one.
+func JoinVoiceChannel(s *discordgo.Session, guildID, channelID string) (*discordgo.VoiceConnection, error) {
+	s.RLock()
+	vc := s.VoiceConnections[guildID]
+	s.RUnlock()
+	if vc != nil {
+		vc.RLock()
+		connected := vc.Ready && vc.ChannelID == channelID
+		vc.RUnlock()
+		if connected {
+			return vc, nil
+		}
+	}
+	return s.ChannelVoiceJoin(guildID, channelID, false, true)
+}
@@ -0,0 +1,115 @@
+// Generates the join and leave clips of guild members ahead of time, so that
+// announcing someone for the first time doesn't wait for the TTS provider.
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/goproslowyo/discordgo"
+	"go.uber.org/zap"
+)
+
+type warmJob struct {
+	text  string
+	voice VoiceProfile
+}
+
+// Warmer synthesizes missing clips in the background with a fixed number of
+// workers, limited to a number of TTS requests per minute. A nil Warmer does
+// nothing.
+type Warmer struct {
+	jobs    chan warmJob
+	limiter *time.Ticker
+
+	mQueued sync.Mutex
+	queued  map[string]bool // Clip keys that are waiting or being synthesized.
+}
+
+func NewWarmer(workers int, perMinute int) *Warmer {
+	w := &Warmer{
+		jobs:    make(chan warmJob, 256),
+		limiter: time.NewTicker(time.Minute / time.Duration(perMinute)),
+		queued:  make(map[string]bool),
+	}
+	for i := 0; i < workers; i++ {
+		go w.work()
+	}
+	return w
+}
+
+func (w *Warmer) work() {
+	for job := range w.jobs {
+		if !clipCache.Has(ttsProviderName(), job.text, job.voice) && clipCache.HasRoomToWarm() {
+			<-w.limiter.C
+			if err := clipCache.Warm(context.Background(), ttsProvider, ttsProviderName(), job.text, job.voice); err != nil {
+				logger.Warn("Failed to pre-generate clip", zap.String("text", job.text), zap.Error(err))
+			}
+		}
+		w.mQueued.Lock()
+		delete(w.queued, clipKey(ttsProviderName(), job.voice, job.text))
+		w.mQueued.Unlock()
+	}
+}
+
+// Queues the clips of the member's single join and leave announcements. It
+// blocks while the queue is full.
+func (w *Warmer) WarmMember(gs *GuildSettings, member *discordgo.Member) {
+	if w == nil || member.User.Bot || gs.IsIgnored(member) {
+		return
+	}
+	if !clipCache.HasRoomToWarm() {
+		return
+	}
+	data := memberAnnounceData(gs, member)
+	voice := gs.VoiceFor(member.User)
+	for _, e := range []AnnounceEvent{announceJoin, announceLeave} {
+		texts, err := RenderAllAnnouncements(&gs.Templates, e, data)
+		if err != nil {
+			logger.Sugar().Warnf("Failed to render %s templates: %s", e, err)
+			continue
+		}
+		for _, markup := range texts {
+			text, err := gs.Speech(markup)
+			if err != nil {
+				logger.Sugar().Warnf("Invalid SSML in '%s': %s", markup, err)
+				continue
+			}
+			if clipCache.Has(ttsProviderName(), text, voice) {
+				continue
+			}
+			key := clipKey(ttsProviderName(), voice, text)
+			w.mQueued.Lock()
+			queued := w.queued[key]
+			w.queued[key] = true
+			w.mQueued.Unlock()
+			if !queued {
+				w.jobs <- warmJob{text: text, voice: voice}
+			}
+		}
+	}
+}
+
+// Queues the clips of all members of the guild.
+func (w *Warmer) WarmGuild(s *discordgo.Session, guildID string) {
+	if w == nil {
+		return
+	}
+	members, err := guildMembers(s, guildID)
+	if err != nil {
+		logger.Sugar().Warnf("Not pre-generating clips for guild %s, unable to get the member list: %s", guildID, err)
+		return
+	}
+	gs := GetGuildSettings(guildID)
+	for _, member := range members {
+		w.WarmMember(&gs, member)
+	}
+	logger.Sugar().Debugf("Queued clips of %d members of guild %s.", len(members), guildID)
+}
+
+func guildMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	gs := GetGuildSettings(m.GuildID)
+	// Don't block the event handler if the queue is full.
+	go warmer.WarmMember(&gs, m.Member)
+}
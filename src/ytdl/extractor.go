@@ -166,3 +166,9 @@ func GetAudioURL(meta Metadata) (string, error) {
 		return "", newError("", errInvalidMetadata)
 	}
 }
+
+// Reports whether the media is a live stream, which never ends.
+func IsLive(meta Metadata) bool {
+	live, _ := meta["is_live"].(bool)
+	return live
+}